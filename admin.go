@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maintenanceMode makes /convert answer 503 while set; /health is unaffected
+// so orchestrators keep the process alive
+var maintenanceMode atomic.Bool
+
+// adminAuth requires ADMIN_TOKEN as a bearer token. Admin endpoints are
+// disabled entirely when no token is configured.
+func adminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cfg.AdminToken == "" {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Admin endpoints are disabled"})
+			return
+		}
+
+		token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing or invalid admin token"})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// getMaintenance reports whether maintenance mode is on
+func getMaintenance(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"maintenance": maintenanceMode.Load()})
+}
+
+// setMaintenance turns maintenance mode on or off from a JSON body like
+// {"enabled": true}
+func setMaintenance(c *gin.Context) {
+	var body struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil || body.Enabled == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": `Expected a JSON body like {"enabled": true}`})
+		return
+	}
+
+	maintenanceMode.Store(*body.Enabled)
+	log.Printf("Maintenance mode set to %t", *body.Enabled)
+	c.JSON(http.StatusOK, gin.H{"maintenance": *body.Enabled})
+}
+
+// purgeCache empties the result cache, or with ?pattern= only the entries
+// for uploads whose hex SHA-256 matches the glob, and reports how many were
+// removed
+func purgeCache(c *gin.Context) {
+	if resultCache == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cache is disabled"})
+		return
+	}
+
+	pattern := c.Query("pattern")
+	removed, err := resultCache.Purge(pattern)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid hash pattern", "details": err.Error()})
+		return
+	}
+
+	log.Printf("Purged %d cache entries (pattern %q)", removed, pattern)
+	c.JSON(http.StatusOK, gin.H{"removed": removed})
+}
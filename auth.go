@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// apiKeyContextKey is where apiKeyAuth stores the authenticated key
+const apiKeyContextKey = "apiKey"
+
+// apiKeyAuth requires a valid key from API_KEYS in the X-API-Key header or
+// as a bearer token. It lets every request through when no keys are set.
+func apiKeyAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(cfg.APIKeys) == 0 {
+			c.Next()
+			return
+		}
+
+		key := c.GetHeader("X-API-Key")
+		if key == "" {
+			key, _ = strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		}
+
+		for _, valid := range cfg.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(valid)) == 1 {
+				c.Set(apiKeyContextKey, valid)
+				c.Next()
+				return
+			}
+		}
+
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing or invalid API key"})
+	}
+}
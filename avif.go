@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Output formats chosen by auto_format
+const (
+	formatAVIF     = "avif"
+	formatWebP     = "webp"
+	formatOriginal = "original"
+)
+
+// avifSpeed is avifenc's encoder speed (0 slowest .. 10 fastest); 6 is its
+// own default trade-off
+const avifSpeed = 6
+
+// negotiateFormat picks the output format for auto_format from the client's
+// Accept header: AVIF when advertised and avifenc is installed, then WebP,
+// and otherwise the original upload when it's a JPEG or PNG a browser can
+// already display
+func negotiateFormat(accept, inputFormat string) string {
+	if serverCapabilities.AVIF && acceptsType(accept, "image/avif") {
+		return formatAVIF
+	}
+	if acceptsType(accept, "image/webp") {
+		return formatWebP
+	}
+	if inputFormat == "jpeg" || inputFormat == "png" {
+		return formatOriginal
+	}
+	return formatWebP
+}
+
+// acceptsType reports whether an Accept header lists mediaType explicitly.
+// Wildcards don't count: */* doesn't mean a browser can render AVIF.
+func acceptsType(accept, mediaType string) bool {
+	for _, item := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(item, ";")
+		if strings.TrimSpace(name) != mediaType {
+			continue
+		}
+		// q=0 explicitly refuses the type
+		for _, param := range strings.Split(params, ";") {
+			if q, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// avifFlags builds the avifenc flags for the given options. Only quality and
+// lossless carry over from the WebP options.
+func (o Options) avifFlags() []string {
+	args := []string{"--speed", strconv.Itoa(avifSpeed)}
+	if o.Lossless {
+		return append(args, "--lossless")
+	}
+	return append(args, "-q", strconv.Itoa(o.quality()))
+}
+
+// encodeAVIF converts the source to AVIF with avifenc, returning the encoded
+// image or the tool's output on failure. avifenc only reads JPEG and PNG and
+// can't resize, so the input is first decoded, scaled down to the same
+// maximum width as WebP output and written as PNG.
+func encodeAVIF(ctx context.Context, opts Options, source *sourceImage) ([]byte, []byte, error) {
+	img, err := source.decode()
+	if err != nil {
+		return nil, nil, err
+	}
+	inputPath := source.path
+	if img.Bounds().Dx() > defaultResizeWidth {
+		img = scaleToWidth(img, defaultResizeWidth)
+	}
+
+	pngPath := inputPath + ".avif.png"
+	if err := writePNG(pngPath, img); err != nil {
+		return nil, nil, err
+	}
+
+	outputPath := inputPath + ".avif"
+	args := append(opts.avifFlags(), pngPath, outputPath)
+	if output, err := runTool(ctx, "avifenc", args); err != nil {
+		return nil, output, err
+	}
+	data, err := os.ReadFile(outputPath)
+	return data, nil, err
+}
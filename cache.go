@@ -0,0 +1,249 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheFileExt is the suffix of every entry stored in the cache directory
+const cacheFileExt = ".webp"
+
+// diskCache stores converted images on disk, keyed by input hash and
+// options, and evicts the least recently used entries once the total size
+// exceeds maxBytes. File modification times double as access times so the
+// LRU order survives restarts.
+type diskCache struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	lru     *list.List // front is most recently used
+	entries map[string]*list.Element
+	size    int64
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// resultCache is the conversion cache, nil when CACHE_DIR is unset
+var resultCache *diskCache
+
+// newDiskCache opens (creating if needed) a cache directory and indexes the
+// entries already present in it
+func newDiskCache(dir string, maxBytes int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, privateDirPerm); err != nil {
+		return nil, err
+	}
+
+	d := &diskCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type existing struct {
+		key     string
+		size    int64
+		modTime time.Time
+	}
+	var found []existing
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasPrefix(name, "tmp-") {
+			// Left over from a write interrupted by a crash
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if f.IsDir() || !strings.HasSuffix(name, cacheFileExt) {
+			continue
+		}
+		if !strings.Contains(name, "-") {
+			// Keyed without the input hash by an older version, so never
+			// looked up again
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		found = append(found, existing{strings.TrimSuffix(name, cacheFileExt), info.Size(), info.ModTime()})
+	}
+
+	// Oldest first, so that the most recently used ends up at the front
+	sort.Slice(found, func(i, j int) bool { return found[i].modTime.Before(found[j].modTime) })
+	for _, e := range found {
+		d.entries[e.key] = d.lru.PushFront(&cacheEntry{key: e.key, size: e.size})
+		d.size += e.size
+	}
+
+	d.mu.Lock()
+	d.evict()
+	d.mu.Unlock()
+
+	log.Printf("Cache enabled at %s (%d entries, %d bytes)", dir, len(d.entries), d.size)
+	return d, nil
+}
+
+// cacheKey derives the cache key from the input content hash and every
+// option that affects the output. The key starts with the hex SHA-256 of
+// the upload, the same value DENYLIST_HASHES lists, so that operators can
+// purge every variant of a source image; the options hash follows a "-".
+func cacheKey(inputHash []byte, opts Options) string {
+	// Marshalling follows pointers, unlike %v
+	optsJSON, _ := json.Marshal(opts)
+	optsHash := sha256.Sum256(optsJSON)
+	return hex.EncodeToString(inputHash) + "-" + hex.EncodeToString(optsHash[:])
+}
+
+// cacheKeyInputHash returns the input content hash part of a cache key
+func cacheKeyInputHash(key string) string {
+	inputHash, _, _ := strings.Cut(key, "-")
+	return inputHash
+}
+
+// path returns the on-disk location of a cache entry
+func (d *diskCache) path(key string) string {
+	return filepath.Join(d.dir, key+cacheFileExt)
+}
+
+// Get opens a cached entry and marks it as recently used. The caller must
+// close the returned file.
+func (d *diskCache) Get(key string) (*os.File, os.FileInfo, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	elem, ok := d.entries[key]
+	if !ok {
+		return nil, nil, false
+	}
+
+	path := d.path(key)
+	f, err := os.Open(path)
+	if err != nil {
+		// Removed behind our back; forget it
+		d.remove(elem)
+		return nil, nil, false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		d.remove(elem)
+		return nil, nil, false
+	}
+
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	d.lru.MoveToFront(elem)
+
+	return f, info, true
+}
+
+// Put stores data under key, evicting old entries to stay within maxBytes
+func (d *diskCache) Put(key string, data []byte) error {
+	size := int64(len(data))
+	if size > d.maxBytes {
+		return nil
+	}
+
+	// Write to a temp file first so readers never see a partial entry
+	tmp, err := os.CreateTemp(d.dir, "tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	tmp.Close()
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := os.Rename(tmp.Name(), d.path(key)); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if elem, ok := d.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		d.size += size - entry.size
+		entry.size = size
+		d.lru.MoveToFront(elem)
+	} else {
+		d.entries[key] = d.lru.PushFront(&cacheEntry{key: key, size: size})
+		d.size += size
+	}
+
+	d.evict()
+	return nil
+}
+
+// Purge removes every entry whose input content hash matches a path.Match
+// pattern, or all entries when pattern is empty, returning how many were
+// removed
+func (d *diskCache) Purge(pattern string) (int, error) {
+	if pattern != "" {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return 0, err
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	removed := 0
+	for key, elem := range d.entries {
+		if pattern != "" {
+			if ok, _ := path.Match(pattern, cacheKeyInputHash(key)); !ok {
+				continue
+			}
+		}
+		d.remove(elem)
+		removed++
+	}
+	return removed, nil
+}
+
+// evict removes least recently used entries until the cache fits.
+// d.mu must be held.
+func (d *diskCache) evict() {
+	for d.size > d.maxBytes {
+		oldest := d.lru.Back()
+		if oldest == nil {
+			return
+		}
+		d.remove(oldest)
+	}
+}
+
+// remove deletes an entry from the index and disk. d.mu must be held.
+func (d *diskCache) remove(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	d.lru.Remove(elem)
+	delete(d.entries, entry.key)
+	d.size -= entry.size
+
+	if err := os.Remove(d.path(entry.key)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove cache entry %s: %v", entry.key, err)
+	}
+}
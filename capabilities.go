@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os/exec"
+
+	"github.com/gin-gonic/gin"
+)
+
+// capabilities reports which optional input and output features this server
+// supports, most of which depend on binaries checked at startup
+type capabilities struct {
+	SVG bool `json:"svg"`
+	GIF bool `json:"gif"`
+	// Animated is animated GIF to animated WebP, via gif2webp
+	Animated bool `json:"animated"`
+	AVIF     bool `json:"avif"`
+	// Video is a poster frame from MP4, WebM or AVI input, via ffmpeg
+	Video bool `json:"video"`
+	// HEIC and PDF input have no decoder in this server yet
+	HEIC bool `json:"heic"`
+	PDF  bool `json:"pdf"`
+}
+
+// serverCapabilities is filled in once by detectCapabilities
+var serverCapabilities capabilities
+
+// detectCapabilities records the optional features available on this host.
+// It must run after detectSVGRasterizer.
+func detectCapabilities() {
+	serverCapabilities = capabilities{
+		SVG: svgRasterizer != "",
+		// Still GIFs are decoded in-process
+		GIF:      true,
+		Animated: hasTool("gif2webp"),
+		AVIF:     hasTool("avifenc"),
+		Video:    hasTool("ffmpeg"),
+	}
+	if !serverCapabilities.Animated {
+		log.Printf("Animated GIF output disabled: gif2webp not found")
+	}
+	if !serverCapabilities.AVIF {
+		log.Printf("AVIF output disabled: avifenc not found")
+	}
+	if !serverCapabilities.Video {
+		log.Printf("Video input disabled: ffmpeg not found")
+	}
+}
+
+// hasTool reports whether a command is available on PATH
+func hasTool(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// getCapabilities lets clients check for optional features before sending
+// input the server can't handle
+func getCapabilities(c *gin.Context) {
+	c.JSON(http.StatusOK, serverCapabilities)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// compareContextKey marks a request as coming from /compare-quality
+const compareContextKey = "compare"
+
+// ssimWindow is the side of the square windows SSIM is averaged over
+const ssimWindow = 8
+
+// heatmapGain amplifies pixel differences so that small compression
+// errors are visible in the heatmap
+const heatmapGain = 4
+
+// comparison is the body of a /compare-quality response
+type comparison struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	Size   int `json:"size"`
+	// PSNR is in dB over RGB, null when the images are identical
+	PSNR *float64 `json:"psnr"`
+	// SSIM is the mean structural similarity of the luma, 1 for identical
+	SSIM float64 `json:"ssim"`
+	// Composite is a base64 PNG of the original, the decoded WebP and a
+	// difference heatmap side by side, when composite=true
+	Composite string `json:"composite,omitempty"`
+}
+
+// compareQuality runs the /convert pipeline but answers with how far the
+// WebP is from its source instead of the WebP itself
+func compareQuality(c *gin.Context) {
+	c.Set(compareContextKey, true)
+	convertToWebP(c)
+}
+
+// respondComparison decodes the encoder input and its WebP and responds
+// with their PSNR and SSIM. A resized output is compared against the
+// source scaled to the same dimensions.
+func respondComparison(c *gin.Context, source *sourceImage, webpData []byte) {
+	original, err := source.decode()
+	defer source.release()
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Failed to decode image for comparison"})
+		return
+	}
+	converted, err := webp.Decode(bytes.NewReader(webpData))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to decode converted image"})
+		return
+	}
+
+	bounds := converted.Bounds()
+	if original.Bounds().Size() != bounds.Size() {
+		scaled := image.NewRGBA(bounds)
+		xdraw.CatmullRom.Scale(scaled, bounds, original, original.Bounds(), xdraw.Src, nil)
+		original = scaled
+	}
+
+	result := comparison{
+		Width:  bounds.Dx(),
+		Height: bounds.Dy(),
+		Size:   len(webpData),
+		SSIM:   meanSSIM(original, converted),
+	}
+	if psnr := computePSNR(original, converted); !math.IsInf(psnr, 1) {
+		result.PSNR = &psnr
+	}
+
+	if c.Query("composite") == "true" {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, compositeDiff(original, converted)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode comparison image"})
+			return
+		}
+		result.Composite = base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// rgb8 returns a pixel's 8-bit color channels
+func rgb8(img image.Image, x, y int) (float64, float64, float64) {
+	r, g, b, _ := img.At(x, y).RGBA()
+	return float64(r >> 8), float64(g >> 8), float64(b >> 8)
+}
+
+// computePSNR returns the peak signal-to-noise ratio of b against a over
+// the RGB channels, +Inf for identical images. Both must share bounds.
+func computePSNR(a, b image.Image) float64 {
+	bounds := a.Bounds()
+	var sum float64
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			ar, ag, ab := rgb8(a, x, y)
+			br, bg, bb := rgb8(b, x-bounds.Min.X+b.Bounds().Min.X, y-bounds.Min.Y+b.Bounds().Min.Y)
+			sum += (ar-br)*(ar-br) + (ag-bg)*(ag-bg) + (ab-bb)*(ab-bb)
+		}
+	}
+	mse := sum / float64(3*bounds.Dx()*bounds.Dy())
+	if mse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/mse)
+}
+
+// luma returns an image's BT.601 luma as a row-major slice
+func luma(img image.Image) []float64 {
+	bounds := img.Bounds()
+	values := make([]float64, 0, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b := rgb8(img, x, y)
+			values = append(values, 0.299*r+0.587*g+0.114*b)
+		}
+	}
+	return values
+}
+
+// meanSSIM averages the structural similarity of the two images' luma over
+// non-overlapping ssimWindow squares; images smaller than a window are
+// treated as a single window
+func meanSSIM(a, b image.Image) float64 {
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+	width, height := a.Bounds().Dx(), a.Bounds().Dy()
+	la, lb := luma(a), luma(b)
+	window := min(ssimWindow, width, height)
+
+	var total float64
+	windows := 0
+	for wy := 0; wy+window <= height; wy += window {
+		for wx := 0; wx+window <= width; wx += window {
+			var sumA, sumB, sumAA, sumBB, sumAB float64
+			for y := wy; y < wy+window; y++ {
+				for x := wx; x < wx+window; x++ {
+					va, vb := la[y*width+x], lb[y*width+x]
+					sumA += va
+					sumB += vb
+					sumAA += va * va
+					sumBB += vb * vb
+					sumAB += va * vb
+				}
+			}
+			n := float64(window * window)
+			meanA, meanB := sumA/n, sumB/n
+			varA := sumAA/n - meanA*meanA
+			varB := sumBB/n - meanB*meanB
+			cov := sumAB/n - meanA*meanB
+			total += ((2*meanA*meanB + c1) * (2*cov + c2)) /
+				((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+			windows++
+		}
+	}
+	if windows == 0 {
+		return 1
+	}
+	return total / float64(windows)
+}
+
+// compositeDiff lays out the original, the converted image and a heatmap
+// of their per-pixel difference side by side
+func compositeDiff(original, converted image.Image) image.Image {
+	bounds := converted.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	out := image.NewRGBA(image.Rect(0, 0, 3*width, height))
+	xdraw.Draw(out, image.Rect(0, 0, width, height), original, original.Bounds().Min, xdraw.Src)
+	xdraw.Draw(out, image.Rect(width, 0, 2*width, height), converted, bounds.Min, xdraw.Src)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			ar, ag, ab := rgb8(original, original.Bounds().Min.X+x, original.Bounds().Min.Y+y)
+			br, bg, bb := rgb8(converted, bounds.Min.X+x, bounds.Min.Y+y)
+			diff := max(math.Abs(ar-br), math.Abs(ag-bg), math.Abs(ab-bb))
+			out.Set(2*width+x, y, heatColor(min(1, diff*heatmapGain/255)))
+		}
+	}
+	return out
+}
+
+// heatColor maps 0..1 to black through red to yellow
+func heatColor(t float64) color.RGBA {
+	if t < 0.5 {
+		return color.RGBA{R: uint8(t * 2 * 255), A: 255}
+	}
+	return color.RGBA{R: 255, G: uint8((t - 0.5) * 2 * 255), A: 255}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// conversionSlots bounds how many conversions run at once, since each one
+// holds decoded images in memory and spawns encoder processes. Waiting
+// requests for small uploads are let in ahead of large ones so a few huge
+// conversions can't starve many thumbnails, but a large request that has
+// waited PRIORITY_AGING goes next regardless.
+type conversionSlots struct {
+	limit int
+	aging time.Duration
+
+	mu      sync.Mutex
+	running int
+	small   []*slotWaiter
+	large   []*slotWaiter
+	stats   schedulerStats
+}
+
+// slotWaiter is a queued request, granted a slot when ready is closed
+type slotWaiter struct {
+	ready    chan struct{}
+	queued   time.Time
+	isSmall  bool
+	canceled bool
+}
+
+// schedulerStats counts how slots were handed out, for /metrics
+type schedulerStats struct {
+	// dispatched counts granted slots by size class
+	dispatched [2]int64
+	// aged counts large requests let in ahead of waiting small ones
+	aged int64
+}
+
+// slots is the conversion limiter, nil when MAX_CONCURRENT_CONVERSIONS is 0
+var slots *conversionSlots
+
+func newConversionSlots(limit int, aging time.Duration) *conversionSlots {
+	return &conversionSlots{limit: limit, aging: aging}
+}
+
+// sizeClass is the metrics label and stats index for a request's class
+func sizeClass(isSmall bool) (string, int) {
+	if isSmall {
+		return "small", 1
+	}
+	return "large", 0
+}
+
+// acquire waits for a slot until ctx is done, returning ctx's error if
+// none was granted
+func (s *conversionSlots) acquire(ctx context.Context, isSmall bool) error {
+	s.mu.Lock()
+	s.small = dropCanceled(s.small)
+	s.large = dropCanceled(s.large)
+	if s.running < s.limit && len(s.small) == 0 && len(s.large) == 0 {
+		s.grantLocked(isSmall)
+		s.mu.Unlock()
+		return nil
+	}
+	w := &slotWaiter{ready: make(chan struct{}), queued: time.Now(), isSmall: isSmall}
+	if isSmall {
+		s.small = append(s.small, w)
+	} else {
+		s.large = append(s.large, w)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	select {
+	case <-w.ready:
+		// Granted while giving up; hand the slot on
+		s.mu.Unlock()
+		s.release()
+	default:
+		// Dequeued lazily by next
+		w.canceled = true
+		s.mu.Unlock()
+	}
+	return ctx.Err()
+}
+
+// release frees a slot and hands it to the next waiting request
+func (s *conversionSlots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	for s.running < s.limit {
+		w := s.nextLocked()
+		if w == nil {
+			return
+		}
+		s.grantLocked(w.isSmall)
+		close(w.ready)
+	}
+}
+
+func (s *conversionSlots) grantLocked(isSmall bool) {
+	s.running++
+	_, i := sizeClass(isSmall)
+	s.stats.dispatched[i]++
+}
+
+// nextLocked pops the next waiter to run: the oldest small request, unless
+// the oldest large one has waited past the aging threshold
+func (s *conversionSlots) nextLocked() *slotWaiter {
+	s.small = dropCanceled(s.small)
+	s.large = dropCanceled(s.large)
+
+	if len(s.large) > 0 && (len(s.small) == 0 || time.Since(s.large[0].queued) >= s.aging) {
+		if len(s.small) > 0 {
+			s.stats.aged++
+		}
+		w := s.large[0]
+		s.large = s.large[1:]
+		return w
+	}
+	if len(s.small) > 0 {
+		w := s.small[0]
+		s.small = s.small[1:]
+		return w
+	}
+	return nil
+}
+
+// dropCanceled removes waiters that gave up from the head of a queue
+func dropCanceled(queue []*slotWaiter) []*slotWaiter {
+	for len(queue) > 0 && queue[0].canceled {
+		queue = queue[1:]
+	}
+	return queue
+}
+
+// isSmallRequest reports whether a request's declared body size is under
+// SMALL_IMAGE_BYTES. Bodies of unknown length count as large.
+func isSmallRequest(c *gin.Context) bool {
+	return cfg.SmallImageBytes > 0 && c.Request.ContentLength > 0 && c.Request.ContentLength <= cfg.SmallImageBytes
+}
+
+// concurrencyMiddleware holds a conversion slot for the duration of the
+// request. Requests wait up to CONVERSION_QUEUE_TIMEOUT for a free slot and
+// are then turned away with 503.
+func concurrencyMiddleware(slots *conversionSlots) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), cfg.ConversionQueueTimeout)
+		defer cancel()
+
+		if err := slots.acquire(ctx, isSmallRequest(c)); err != nil {
+			if c.Request.Context().Err() != nil {
+				c.Abort()
+				return
+			}
+			c.Header("Retry-After", "1")
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Server is busy, try again shortly"})
+			return
+		}
+		defer slots.release()
+
+		c.Next()
+	}
+}
+
+// writeMetrics appends the scheduler's series to a /metrics response
+func (s *conversionSlots) writeMetrics(b *strings.Builder) {
+	s.mu.Lock()
+	stats := s.stats
+	running := s.running
+	queued := [2]int{}
+	for _, w := range s.large {
+		if !w.canceled {
+			queued[0]++
+		}
+	}
+	for _, w := range s.small {
+		if !w.canceled {
+			queued[1]++
+		}
+	}
+	s.mu.Unlock()
+
+	b.WriteString("# HELP webp_scheduler_dispatched_total Conversion slots granted by request size class.\n")
+	b.WriteString("# TYPE webp_scheduler_dispatched_total counter\n")
+	for _, isSmall := range []bool{false, true} {
+		label, i := sizeClass(isSmall)
+		fmt.Fprintf(b, "webp_scheduler_dispatched_total{class=%q} %d\n", label, stats.dispatched[i])
+	}
+
+	b.WriteString("# HELP webp_scheduler_aged_total Large requests let in ahead of small ones after waiting PRIORITY_AGING.\n")
+	b.WriteString("# TYPE webp_scheduler_aged_total counter\n")
+	fmt.Fprintf(b, "webp_scheduler_aged_total %d\n", stats.aged)
+
+	b.WriteString("# HELP webp_scheduler_queued Requests waiting for a conversion slot by size class.\n")
+	b.WriteString("# TYPE webp_scheduler_queued gauge\n")
+	for _, isSmall := range []bool{false, true} {
+		label, i := sizeClass(isSmall)
+		fmt.Fprintf(b, "webp_scheduler_queued{class=%q} %d\n", label, queued[i])
+	}
+
+	b.WriteString("# HELP webp_scheduler_running Conversions holding a slot.\n")
+	b.WriteString("# TYPE webp_scheduler_running gauge\n")
+	fmt.Fprintf(b, "webp_scheduler_running %d\n", running)
+}
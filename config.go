@@ -0,0 +1,323 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server settings read at startup from the environment
+// and, for anything the environment leaves unset, CONFIG_FILE
+type Config struct {
+	Port string
+	// IdleTimeout closes keep-alive connections idle for this long
+	IdleTimeout time.Duration
+	// MaxHeaderBytes caps the size of request headers
+	MaxHeaderBytes int
+	// KeepAlives toggles HTTP keep-alive connection reuse
+	KeepAlives bool
+	// ShutdownTimeout bounds how long in-flight requests may drain on
+	// shutdown
+	ShutdownTimeout time.Duration
+	// MaxConversionsBeforeExit gracefully stops the process after this
+	// many conversions, 0 to never recycle
+	MaxConversionsBeforeExit int
+	// MaxPixels caps width*height of decoded input to guard against
+	// decompression bombs
+	MaxPixels int
+	// MaxAnimFrames and MaxAnimDurationMs cap animated GIF input before
+	// gif2webp runs, 0 for no limit
+	MaxAnimFrames     int
+	MaxAnimDurationMs int
+	// MaxUploadBytes caps the request body after any decompression
+	MaxUploadBytes int64
+	// StreamUploads reads multipart uploads as they arrive instead of
+	// buffering the form, piping them into cwebp's stdin when no
+	// preprocessing is needed
+	StreamUploads bool
+	// MultipartDuplicatePolicy decides what happens to an upload with more
+	// than one "image" field: first, strict or batch. Only first allows
+	// streaming uploads.
+	MultipartDuplicatePolicy string
+	// MaxBatchFiles caps the images in one batch upload. A batch takes a
+	// single quota unit and conversion slot, so it must stay small; 0
+	// means no cap.
+	MaxBatchFiles int
+	// FormatMaxUploadBytes holds per-format overrides of MaxUploadBytes
+	// from MAX_UPLOAD_BYTES_<FORMAT>, keyed by detected format
+	FormatMaxUploadBytes map[string]int64
+	// Debug exposes encoder internals such as the cwebp arguments in
+	// response headers
+	Debug bool
+	// SanitizeErrors replaces raw cwebp output in error responses with
+	// friendly messages; on by default unless DEBUG is set
+	SanitizeErrors bool
+	// LogSampleRate logs one in this many successful requests; errors and
+	// requests slower than LogSlowThreshold are always logged
+	LogSampleRate    int
+	LogSlowThreshold time.Duration
+	// EnablePprof mounts the net/http/pprof handlers under /debug/pprof
+	EnablePprof bool
+	// AllowedQualities, when non-empty, restricts the quality parameter to
+	// these values so outputs are shared across clients. Other values are
+	// rejected, or snapped to the nearest allowed one with QualitySnap.
+	AllowedQualities []int
+	QualitySnap      bool
+	// MinQuality is the lowest quality a request may ask for, 0 for no
+	// floor. Lower values are rejected, or raised to it with ClampQuality.
+	MinQuality   int
+	ClampQuality bool
+	// QualityTiers pick the default quality from an image's decoded size,
+	// for requests that don't set one, see qualityTiers
+	QualityTiers []qualityTier
+	// MaxConcurrentConversions caps simultaneous conversions, 0 for
+	// unlimited; excess requests queue for up to ConversionQueueTimeout
+	MaxConcurrentConversions int
+	ConversionQueueTimeout   time.Duration
+	// SmallImageBytes lets queued uploads up to this size in ahead of
+	// larger ones, 0 for plain arrival order; a large request that has
+	// waited PriorityAging is let in next anyway
+	SmallImageBytes int64
+	PriorityAging   time.Duration
+	// CwebpRetries is how many times a transiently failing cwebp run is
+	// retried, starting CwebpRetryBackoff apart and doubling
+	CwebpRetries      int
+	CwebpRetryBackoff time.Duration
+	// CacheDir enables the on-disk conversion cache when set
+	CacheDir string
+	// CacheMaxBytes caps the total size of the cache directory
+	CacheMaxBytes int64
+	// Denylist holds the hex SHA-256 of uploads that are refused with 403
+	Denylist map[string]bool
+	// Provenance is the default for the provenance option, which embeds
+	// an XMP packet recording how the output was made
+	Provenance bool
+	// AllowLocalPaths lets JSON requests name a file under LocalPathBase
+	// instead of uploading it, for trusted co-located clients only
+	AllowLocalPaths bool
+	LocalPathBase   string
+	// StaleTempAge is how old a leftover working directory must be before
+	// the disk-full recovery sweep removes it
+	StaleTempAge time.Duration
+	// UploadDir holds partial resumable uploads, which expire UploadTTL
+	// after they are created
+	UploadDir string
+	UploadTTL time.Duration
+	// ResultTTL is how long a /convert/stream result stays downloadable
+	ResultTTL time.Duration
+	// FilenameTemplate builds the download filename, see renderFilename
+	FilenameTemplate string
+	// AdminToken guards the /admin endpoints, which are disabled when empty
+	AdminToken string
+	// APIKeys, when non-empty, are required to call /convert
+	APIKeys []string
+	// QuotaLimit caps conversions per API key within QuotaWindow, 0 for
+	// unlimited
+	QuotaLimit  int
+	QuotaWindow time.Duration
+	// OTLPEndpoint is the OTLP/HTTP collector URL; tracing is a no-op
+	// when it is empty. The exporter itself reads the standard OTEL_*
+	// variables.
+	OTLPEndpoint string
+	ServiceName  string
+	// DefaultOptions are the conversion options from CONFIG_FILE that
+	// requests start from
+	DefaultOptions Options
+}
+
+// cfg is the active configuration, populated once in main()
+var cfg Config
+
+// loadConfig reads the configuration from environment variables, falling
+// back to CONFIG_FILE entries
+func loadConfig() Config {
+	var defaults Options
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		settings, options, err := loadConfigFile(path)
+		if err != nil {
+			log.Fatalf("Failed to load CONFIG_FILE %s: %v", path, err)
+		}
+		fileSettings, defaults = settings, options
+	}
+
+	debug := envBool("DEBUG", false)
+
+	c := Config{
+		Port:           envString("PORT", "8080"),
+		IdleTimeout:    envDuration("IDLE_TIMEOUT", 120*time.Second),
+		MaxHeaderBytes: envInt("MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes),
+		KeepAlives:     envBool("KEEP_ALIVES", true),
+		MaxPixels:      envInt("MAX_PIXELS", 50_000_000),
+		MaxUploadBytes: int64(envInt("MAX_UPLOAD_BYTES", 10<<20)),
+		Debug:          debug,
+
+		MaxAnimFrames:     envInt("MAX_ANIM_FRAMES", 1000),
+		MaxAnimDurationMs: envInt("MAX_ANIM_DURATION_MS", 120_000),
+
+		FormatMaxUploadBytes: formatUploadLimits(),
+		StreamUploads:        envBool("STREAM_UPLOADS", false),
+
+		MultipartDuplicatePolicy: envString("MULTIPART_DUPLICATE_POLICY", duplicateFirst),
+		MaxBatchFiles:            envInt("MAX_BATCH_FILES", 10),
+
+		SanitizeErrors: envBool("SANITIZE_ERRORS", !debug),
+		EnablePprof:    envBool("ENABLE_PPROF", false),
+
+		LogSampleRate:    envInt("LOG_SAMPLE_RATE", 1),
+		LogSlowThreshold: envDuration("LOG_SLOW_THRESHOLD", time.Second),
+
+		ShutdownTimeout:          envDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		MaxConversionsBeforeExit: envInt("MAX_CONVERSIONS_BEFORE_EXIT", 0),
+
+		AllowedQualities: envIntList("ALLOWED_QUALITIES"),
+		QualitySnap:      envBool("QUALITY_SNAP", false),
+		MinQuality:       envInt("MIN_QUALITY", 0),
+		ClampQuality:     envBool("CLAMP_QUALITY", true),
+		QualityTiers:     qualityTiers(),
+
+		MaxConcurrentConversions: envInt("MAX_CONCURRENT_CONVERSIONS", 0),
+		ConversionQueueTimeout:   envDuration("CONVERSION_QUEUE_TIMEOUT", 30*time.Second),
+		SmallImageBytes:          int64(envInt("SMALL_IMAGE_BYTES", 0)),
+		PriorityAging:            envDuration("PRIORITY_AGING", 5*time.Second),
+
+		CwebpRetries:      envInt("CWEBP_RETRIES", 2),
+		CwebpRetryBackoff: envDuration("CWEBP_RETRY_BACKOFF", 100*time.Millisecond),
+
+		CacheDir:      setting("CACHE_DIR"),
+		CacheMaxBytes: int64(envInt("CACHE_MAX_BYTES", 1<<30)),
+
+		Denylist:   loadDenylist(),
+		Provenance: envBool("PROVENANCE", false),
+
+		AllowLocalPaths: envBool("ALLOW_LOCAL_PATHS", false),
+		LocalPathBase:   setting("LOCAL_PATH_BASE"),
+
+		StaleTempAge: envDuration("STALE_TEMP_AGE", time.Hour),
+
+		UploadDir: envString("UPLOAD_DIR", filepath.Join(os.TempDir(), "webp-uploads")),
+		UploadTTL: envDuration("UPLOAD_TTL", 24*time.Hour),
+		ResultTTL: envDuration("RESULT_TTL", 10*time.Minute),
+
+		FilenameTemplate: envString("FILENAME_TEMPLATE", defaultFilenameTemplate),
+
+		AdminToken:  setting("ADMIN_TOKEN"),
+		APIKeys:     envList("API_KEYS"),
+		QuotaLimit:  envInt("QUOTA_LIMIT", 0),
+		QuotaWindow: envDuration("QUOTA_WINDOW", time.Hour),
+
+		OTLPEndpoint: envString("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", setting("OTEL_EXPORTER_OTLP_ENDPOINT")),
+		ServiceName:  envString("OTEL_SERVICE_NAME", "image-compress-go-webp"),
+
+		DefaultOptions: defaults,
+	}
+	warnUnknownSettings()
+	return c
+}
+
+// limitedFormats are the detected formats that accept a
+// MAX_UPLOAD_BYTES_<FORMAT> override
+var limitedFormats = []string{"jpeg", "png", "gif", "tiff", "webp", "bmp", "svg"}
+
+// formatUploadLimits reads the per-format upload size overrides
+func formatUploadLimits() map[string]int64 {
+	limits := make(map[string]int64)
+	for _, format := range limitedFormats {
+		if limit := envInt("MAX_UPLOAD_BYTES_"+strings.ToUpper(format), 0); limit > 0 {
+			limits[format] = int64(limit)
+		}
+	}
+	return limits
+}
+
+// uploadLimit returns the upload size limit for a detected format, falling
+// back to MAX_UPLOAD_BYTES
+func uploadLimit(format string) int64 {
+	if limit, ok := cfg.FormatMaxUploadBytes[format]; ok {
+		return limit
+	}
+	return cfg.MaxUploadBytes
+}
+
+// envString returns the value of an environment variable or a default
+func envString(name, def string) string {
+	if value := setting(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// envInt returns an integer environment variable or a default when it is
+// unset or invalid
+func envInt(name string, def int) int {
+	value := setting(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %d", name, value, def)
+		return def
+	}
+	return n
+}
+
+// envBool returns a boolean environment variable or a default when it is
+// unset or invalid
+func envBool(name string, def bool) bool {
+	value := setting(name)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %t", name, value, def)
+		return def
+	}
+	return b
+}
+
+// envDuration returns a duration environment variable (e.g. "30s") or a
+// default when it is unset or invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	value := setting(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %s", name, value, def)
+		return def
+	}
+	return d
+}
+
+// envList splits a comma-separated environment variable, dropping empty
+// items
+func envList(name string) []string {
+	var items []string
+	for _, item := range strings.Split(setting(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envIntList parses a comma-separated list of integers, skipping invalid
+// items
+func envIntList(name string) []int {
+	var values []int
+	for _, item := range envList(name) {
+		n, err := strconv.Atoi(item)
+		if err != nil {
+			log.Printf("Ignoring invalid %s item %q", name, item)
+			continue
+		}
+		values = append(values, n)
+	}
+	return values
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// configFileOptionsKey is the config file entry holding default conversion
+// options; every other entry is a setting named like its environment
+// variable
+const configFileOptionsKey = "OPTIONS"
+
+// fileSettings are the settings read from CONFIG_FILE, keyed by their
+// upper-cased environment variable name
+var fileSettings map[string]string
+
+// usedSettings records which names the configuration asked for, to report
+// config file entries that match no setting
+var usedSettings = make(map[string]bool)
+
+// setting returns a setting's value: the environment variable when set,
+// otherwise the CONFIG_FILE entry, otherwise ""
+func setting(name string) string {
+	usedSettings[name] = true
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fileSettings[name]
+}
+
+// loadConfigFile reads a JSON config file such as
+//
+//	{"max_upload_bytes": 5242880, "api_keys": ["a", "b"], "options": {"quality": 70}}
+//
+// Keys are environment variable names in any case. Lists are joined with
+// commas as the list variables expect. "options" holds the default
+// conversion options, which query parameters override per request.
+func loadConfigFile(path string) (map[string]string, Options, error) {
+	settings := make(map[string]string)
+	var defaults Options
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, defaults, err
+	}
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, defaults, err
+	}
+
+	for key, raw := range entries {
+		name := strings.ToUpper(key)
+		if name == configFileOptionsKey {
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&defaults); err != nil {
+				return nil, defaults, fmt.Errorf("options: %w", err)
+			}
+			continue
+		}
+		value, err := settingValue(raw)
+		if err != nil {
+			return nil, defaults, fmt.Errorf("%s: %w", key, err)
+		}
+		settings[name] = value
+	}
+	return settings, defaults, nil
+}
+
+// settingValue renders a config file value the way it would be written in
+// the environment
+func settingValue(raw json.RawMessage) (string, error) {
+	var value any
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", err
+	}
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64, bool:
+		return string(bytes.TrimSpace(raw)), nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("must be a string, number, boolean or list")
+}
+
+// warnUnknownSettings logs config file entries that no setting read, which
+// are usually typos
+func warnUnknownSettings() {
+	var unknown []string
+	for name := range fileSettings {
+		if !usedSettings[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		log.Printf("Ignoring unknown setting %q in CONFIG_FILE", name)
+	}
+}
+
+// logEffectiveConfig logs the configuration in use after merging the
+// environment, CONFIG_FILE and defaults, with secrets redacted
+func logEffectiveConfig(c Config) {
+	if c.AdminToken != "" {
+		c.AdminToken = "[redacted]"
+	}
+	if len(c.APIKeys) > 0 {
+		c.APIKeys = []string{fmt.Sprintf("[%d redacted]", len(c.APIKeys))}
+	}
+	denylisted := len(c.Denylist)
+	c.Denylist = nil
+	defaults, _ := json.Marshal(c.DefaultOptions)
+	c.DefaultOptions = Options{}
+
+	log.Printf("Effective config: %+v", c)
+	log.Printf("Default conversion options: %s, %d denylisted hashes", defaults, denylisted)
+}
+
+// validateDefaultOptions checks the CONFIG_FILE options as a request
+// carrying only them would be checked
+func validateDefaultOptions(opts Options) error {
+	if opts.Orient == "" {
+		opts.Orient = orientRotatePixels
+	}
+	opts.Background = strings.TrimPrefix(strings.ToLower(opts.Background), "#")
+	return validateOptions(opts)
+}
+
+// defaultOptions returns a deep copy of the configured default options, so
+// that decoding a request's options into it can't modify the defaults
+func defaultOptions() Options {
+	var opts Options
+	encoded, err := json.Marshal(cfg.DefaultOptions)
+	if err == nil {
+		json.Unmarshal(encoded, &opts)
+	}
+	return opts
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// loadDenylist reads the SHA-256 hashes of blocked uploads from
+// DENYLIST_HASHES (comma-separated) and DENYLIST_FILE (one per line, #
+// comments allowed). Malformed entries are logged and skipped.
+func loadDenylist() map[string]bool {
+	entries := envList("DENYLIST_HASHES")
+	if path := setting("DENYLIST_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Failed to read DENYLIST_FILE: %v", err)
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line, _, _ = strings.Cut(line, "#")
+			if line = strings.TrimSpace(line); line != "" {
+				entries = append(entries, line)
+			}
+		}
+	}
+
+	denylist := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		entry = strings.ToLower(entry)
+		if decoded, err := hex.DecodeString(entry); err != nil || len(decoded) != 32 {
+			log.Printf("Ignoring invalid denylist entry %q, expected a SHA-256 hex digest", entry)
+			continue
+		}
+		denylist[entry] = true
+	}
+	if len(denylist) > 0 {
+		log.Printf("Blocking %d denylisted image hashes", len(denylist))
+	}
+	return denylist
+}
+
+// isDenylisted reports whether an upload's SHA-256, the same hash the
+// cache key is built from, is on the denylist
+func isDenylisted(inputHash []byte) bool {
+	return cfg.Denylist[hex.EncodeToString(inputHash)]
+}
+
+// rejectDenylisted responds 403 for a blocked upload
+func rejectDenylisted(c *gin.Context) {
+	c.JSON(http.StatusForbidden, gin.H{"error": "This image is blocked"})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// runCwebp encodes inputPath to outputPath with the given flags, returning
+// cwebp's combined output
+func runCwebp(ctx context.Context, flags []string, inputPath, outputPath string) ([]byte, error) {
+	return runEncoder(ctx, "cwebp", flags, inputPath, outputPath)
+}
+
+// runCwebpStdin encodes image data read from stdin to outputPath. The input
+// can only be read once, so transient failures aren't retried.
+func runCwebpStdin(ctx context.Context, flags []string, stdin io.Reader, outputPath string) ([]byte, error) {
+	args := append(append([]string{}, flags...), "-o", outputPath, "--", "-")
+	cmd := exec.CommandContext(ctx, "cwebp", args...)
+	cmd.Stdin = stdin
+	output, err := cmd.CombinedOutput()
+	return output, diskFullError("cwebp", output, err)
+}
+
+// encodeSmallest encodes inputPath both lossy and lossless, keeping the
+// smaller result at outputPath, and returns the winning mode ("lossy" or
+// "lossless"). flagsFor builds the encoder flags for each variant.
+func encodeSmallest(ctx context.Context, encoder string, flagsFor func(Options) []string, opts Options, inputPath, outputPath string) (string, []byte, error) {
+	lossless := opts
+	lossless.Lossless = true
+	losslessPath := outputPath + ".lossless"
+
+	if output, err := runEncoder(ctx, encoder, flagsFor(opts), inputPath, outputPath); err != nil {
+		return "", output, err
+	}
+	if output, err := runEncoder(ctx, encoder, flagsFor(lossless), inputPath, losslessPath); err != nil {
+		return "", output, err
+	}
+
+	lossyInfo, err := os.Stat(outputPath)
+	if err != nil {
+		return "", nil, err
+	}
+	losslessInfo, err := os.Stat(losslessPath)
+	if err != nil {
+		return "", nil, err
+	}
+	if losslessInfo.Size() < lossyInfo.Size() {
+		return "lossless", nil, os.Rename(losslessPath, outputPath)
+	}
+	return "lossy", nil, nil
+}
+
+// runEncoder runs a libwebp command line tool (cwebp, gif2webp) that takes
+// "flags... input -o output"
+func runEncoder(ctx context.Context, tool string, flags []string, inputPath, outputPath string) ([]byte, error) {
+	args := append(append([]string{}, flags...), inputPath, "-o", outputPath)
+	return runTool(ctx, tool, args)
+}
+
+// runTool runs an encoder and returns its combined output. Transient
+// failures to start the process are retried up to CWEBP_RETRIES times with
+// exponential backoff; a non-zero exit from the tool itself means bad input
+// and is returned immediately, unless the disk filled up under it.
+func runTool(ctx context.Context, tool string, args []string) ([]byte, error) {
+	backoff := cfg.CwebpRetryBackoff
+
+	for attempt := 0; ; attempt++ {
+		output, err := exec.CommandContext(ctx, tool, args...).CombinedOutput()
+		if err == nil || attempt >= cfg.CwebpRetries || !isTransientExecError(ctx, err) {
+			return output, diskFullError(tool, output, err)
+		}
+
+		log.Printf("%s failed transiently (%v), retrying in %s (attempt %d of %d)", tool, err, backoff, attempt+1, cfg.CwebpRetries)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return output, diskFullError(tool, output, err)
+		}
+		backoff *= 2
+	}
+}
+
+// isTransientExecError reports whether an encoder run failed because of
+// resource pressure rather than its input: the fork/exec itself failing
+// with EAGAIN or ENOMEM, or the process being SIGKILLed (typically by the
+// OOM killer) while the request was still live
+func isTransientExecError(ctx context.Context, err error) bool {
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ENOMEM) {
+		return true
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.Signaled() && status.Signal() == syscall.SIGKILL
+		}
+	}
+	return false
+}
+
+// diskFullError wraps a failed encoder run in ENOSPC when the tool says it
+// couldn't write its output for lack of space, so respondDiskFull answers
+// 507 rather than blaming the input
+func diskFullError(tool string, output []byte, err error) error {
+	if err == nil || errors.Is(err, syscall.ENOSPC) {
+		return err
+	}
+	if bytes.Contains(output, []byte("No space left on device")) {
+		return fmt.Errorf("%s: %w", tool, syscall.ENOSPC)
+	}
+	return err
+}
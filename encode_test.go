@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+	"testing"
+)
+
+func TestDiskFullError(t *testing.T) {
+	exitErr := &exec.ExitError{}
+	tests := []struct {
+		name     string
+		output   string
+		err      error
+		diskFull bool
+	}{
+		{"success", "No space left on device", nil, false},
+		{"out of space", "Error! Cannot open output file 'out.webp'\nNo space left on device\n", exitErr, true},
+		{"bad input", "Error! Could not process file in.png\nStatus: 3(BITSTREAM_ERROR)\n", exitErr, false},
+		{"already ENOSPC", "", syscall.ENOSPC, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := diskFullError("cwebp", []byte(tt.output), tt.err)
+			if got := errors.Is(err, syscall.ENOSPC); got != tt.diskFull {
+				t.Errorf("errors.Is(err, ENOSPC) = %t, want %t (err %v)", got, tt.diskFull, err)
+			}
+			if tt.err == nil && err != nil {
+				t.Errorf("err = %v, want nil for a successful run", err)
+			}
+		})
+	}
+}
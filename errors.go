@@ -0,0 +1,54 @@
+package main
+
+import "strings"
+
+// cwebpFailures maps fragments of cwebp's error output to messages that are
+// safe to show clients. The first match wins.
+var cwebpFailures = []struct {
+	pattern string
+	message string
+}{
+	{"Unsupported image format", "Unsupported image format"},
+	{"BAD_DIMENSION", "Image dimensions are not supported by the encoder"},
+	{"FILE_TOO_BIG", "Image is too large to encode as WebP"},
+	{"OUT_OF_MEMORY", "Not enough memory to encode the image"},
+	{"Premature end", "Image data is truncated or corrupt"},
+	{"truncated", "Image data is truncated or corrupt"},
+	{"Could not process file", "Image could not be decoded"},
+	{"Cannot read input", "Image could not be decoded"},
+	{"Error! Could not", "Image could not be decoded"},
+}
+
+// cwebpErrorDetails returns what to report to the client about a failed
+// cwebp run: the raw output when SANITIZE_ERRORS is off, otherwise a
+// friendly description that doesn't leak paths or encoder internals
+func cwebpErrorDetails(output []byte) string {
+	if !cfg.SanitizeErrors {
+		return string(output)
+	}
+
+	for _, failure := range cwebpFailures {
+		if strings.Contains(string(output), failure.pattern) {
+			return failure.message
+		}
+	}
+	return "The encoder rejected the image"
+}
+
+// rasterizeErrorDetails returns what to report to the client about a failed
+// SVG rasterization, honouring SANITIZE_ERRORS
+func rasterizeErrorDetails(output []byte) string {
+	if !cfg.SanitizeErrors {
+		return string(output)
+	}
+	return "The SVG could not be parsed or rendered"
+}
+
+// videoErrorDetails returns what to report to the client about a failed
+// ffmpeg frame extraction, honouring SANITIZE_ERRORS
+func videoErrorDetails(output []byte) string {
+	if !cfg.SanitizeErrors {
+		return string(output)
+	}
+	return "The video could not be decoded"
+}
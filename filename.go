@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultFilenameTemplate reproduces the original naming: the upload's name
+// with a .webp extension
+const defaultFilenameTemplate = "{base}.webp"
+
+// sanitizeFilename reduces a client-supplied name to a safe set of
+// characters for use in paths and the Content-Disposition header
+func sanitizeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, filepath.Base(name))
+
+	name = strings.Trim(name, "._")
+	if name == "" {
+		return "image"
+	}
+	return name
+}
+
+// renderFilename builds the download filename from FILENAME_TEMPLATE.
+// Supported placeholders are {base} (upload name without extension),
+// {hash} (first 12 hex digits of the input's SHA-256) and {date}
+// (UTC, YYYYMMDD).
+func renderFilename(template, uploadName string, inputHash []byte, now time.Time) string {
+	base := sanitizeFilename(filenameWithoutExt(filepath.Base(uploadName)))
+
+	name := strings.NewReplacer(
+		"{base}", base,
+		"{hash}", hex.EncodeToString(inputHash)[:12],
+		"{date}", now.UTC().Format("20060102"),
+	).Replace(template)
+
+	return forceExtension(name, ".webp")
+}
+
+// forceExtension sanitizes a download filename and makes ext its only
+// extension, so that neither the upload name, the filename parameter nor
+// the template can suggest another type. The final extension is replaced
+// and inner dots become underscores: evil.php.webp becomes evil_php.webp,
+// while photo.2024.01.jpg keeps its date as photo_2024_01.webp.
+func forceExtension(name, ext string) string {
+	name = sanitizeFilename(name)
+	if i := strings.LastIndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	name = strings.TrimRight(strings.ReplaceAll(name, ".", "_"), "_")
+	if name == "" {
+		name = "image"
+	}
+	return name + ext
+}
+
+// formatExtension is the usual file extension for a detected input format
+func formatExtension(format string) string {
+	if format == "jpeg" {
+		return ".jpg"
+	}
+	return "." + format
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestForceExtension(t *testing.T) {
+	tests := []struct {
+		name, ext, want string
+	}{
+		{"photo.jpg", ".webp", "photo.webp"},
+		{"photo", ".webp", "photo.webp"},
+		{"evil.php.webp", ".webp", "evil_php.webp"},
+		{"evil.php", ".webp", "evil.webp"},
+		{"name.exe", ".webp", "name.webp"},
+		{"photo.2024.01.jpg", ".webp", "photo_2024_01.webp"},
+		{"archive.tar.gz", ".avif", "archive_tar.avif"},
+		{"../../etc/passwd", ".webp", "passwd.webp"},
+		{"shell;rm -rf.png", ".webp", "shell_rm_-rf.webp"},
+		{".hidden", ".webp", "hidden.webp"},
+		{"...", ".webp", "image.webp"},
+		{"", ".jpg", "image.jpg"},
+	}
+	for _, tt := range tests {
+		if got := forceExtension(tt.name, tt.ext); got != tt.want {
+			t.Errorf("forceExtension(%q, %q) = %q, want %q", tt.name, tt.ext, got, tt.want)
+		}
+	}
+}
+
+func TestRenderFilename(t *testing.T) {
+	hash := make([]byte, 32)
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		template, upload, want string
+	}{
+		{defaultFilenameTemplate, "photo.jpg", "photo.webp"},
+		{defaultFilenameTemplate, "photo.2024.01.jpg", "photo_2024_01.webp"},
+		{defaultFilenameTemplate, "evil.php.png", "evil_php.webp"},
+		{"{base}.exe", "name.png", "name.webp"},
+		{"{base}-{hash}", "name.png", "name-000000000000.webp"},
+	}
+	for _, tt := range tests {
+		if got := renderFilename(tt.template, tt.upload, hash, now); got != tt.want {
+			t.Errorf("renderFilename(%q, %q) = %q, want %q", tt.template, tt.upload, got, tt.want)
+		}
+	}
+}
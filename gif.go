@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+	"strconv"
+)
+
+// decodeGIF reads every frame of a GIF file
+func decodeGIF(path string) (*gif.GIF, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return gif.DecodeAll(f)
+}
+
+// GIF block introducers and the Graphic Control Extension label
+const (
+	gifExtension      = 0x21
+	gifImageSeparator = 0x2c
+	gifTrailer        = 0x3b
+	gifGraphicControl = 0xf9
+)
+
+// scanGIF counts the frames of a GIF file and adds up their delays in
+// milliseconds by walking its blocks, skipping the LZW image data, so that
+// long animations can be turned away before any frame is decoded. Each
+// frame takes the delay of the Graphic Control Extension preceding it, as
+// in gif.DecodeAll.
+func scanGIF(path string) (int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	// Header and logical screen descriptor
+	var header [13]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, 0, err
+	}
+	if string(header[:6]) != "GIF87a" && string(header[:6]) != "GIF89a" {
+		return 0, 0, errors.New("not a GIF")
+	}
+	if err := skipGIFColorTable(r, header[10]); err != nil {
+		return 0, 0, err
+	}
+
+	frames, durationMs, delay := 0, 0, 0
+	for {
+		introducer, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, err
+		}
+		switch introducer {
+		case gifExtension:
+			label, err := r.ReadByte()
+			if err != nil {
+				return 0, 0, err
+			}
+			if label == gifGraphicControl {
+				var block [5]byte
+				if _, err := io.ReadFull(r, block[:]); err != nil {
+					return 0, 0, err
+				}
+				if block[0] != 4 {
+					return 0, 0, fmt.Errorf("invalid graphic control extension size %d", block[0])
+				}
+				delay = int(block[2]) | int(block[3])<<8
+			}
+			if err := skipGIFSubBlocks(r); err != nil {
+				return 0, 0, err
+			}
+		case gifImageSeparator:
+			var descriptor [9]byte
+			if _, err := io.ReadFull(r, descriptor[:]); err != nil {
+				return 0, 0, err
+			}
+			if err := skipGIFColorTable(r, descriptor[8]); err != nil {
+				return 0, 0, err
+			}
+			// LZW minimum code size, then the image data
+			if _, err := r.ReadByte(); err != nil {
+				return 0, 0, err
+			}
+			if err := skipGIFSubBlocks(r); err != nil {
+				return 0, 0, err
+			}
+			frames++
+			durationMs += delay * 10
+			delay = 0
+		case gifTrailer:
+			return frames, durationMs, nil
+		default:
+			return 0, 0, fmt.Errorf("unknown GIF block type 0x%02x", introducer)
+		}
+	}
+}
+
+// skipGIFColorTable skips the global or local color table that flags, the
+// packed byte of a screen or image descriptor, says follows
+func skipGIFColorTable(r *bufio.Reader, flags byte) error {
+	if flags&0x80 == 0 {
+		return nil
+	}
+	_, err := r.Discard(3 << (flags&0x07 + 1))
+	return err
+}
+
+// skipGIFSubBlocks skips a sequence of data sub-blocks up to and including
+// its zero-length terminator
+func skipGIFSubBlocks(r *bufio.Reader) error {
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err := r.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
+
+// gifFrame renders frame index of an animation as it appears on screen,
+// compositing the preceding frames and honouring their disposal methods
+func gifFrame(anim *gif.GIF, index int) image.Image {
+	canvas := image.NewRGBA(image.Rect(0, 0, anim.Config.Width, anim.Config.Height))
+
+	for i, frame := range anim.Image {
+		var previous *image.RGBA
+		if i < len(anim.Disposal) && anim.Disposal[i] == gif.DisposalPrevious {
+			previous = image.NewRGBA(canvas.Bounds())
+			copy(previous.Pix, canvas.Pix)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		if i == index {
+			break
+		}
+
+		if i < len(anim.Disposal) {
+			switch anim.Disposal[i] {
+			case gif.DisposalBackground:
+				draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+			case gif.DisposalPrevious:
+				canvas = previous
+			}
+		}
+	}
+	return canvas
+}
+
+// gif2webpFlags builds the gif2webp flags for the given options. gif2webp
+// has no resizing or alpha handling, so only the compression settings carry
+// over.
+func (o Options) gif2webpFlags() []string {
+	var args []string
+	if !o.Lossless {
+		args = append(args, "-lossy")
+	}
+	return append(args, "-q", strconv.Itoa(o.quality()))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/gif"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testGIF encodes an animation of frames 2x2 images, each shown for delay
+// hundredths of a second
+func testGIF(t *testing.T, frames, delay int) []byte {
+	t.Helper()
+	palette := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 2, 2), palette)
+		frame.SetColorIndex(i%2, 0, 1)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, delay)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestScanGIF(t *testing.T) {
+	for _, frames := range []int{1, 2, 7} {
+		path := filepath.Join(t.TempDir(), "anim.gif")
+		if err := os.WriteFile(path, testGIF(t, frames, 4), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		gotFrames, gotDuration, err := scanGIF(path)
+		if err != nil {
+			t.Fatalf("scanGIF: %v", err)
+		}
+		if gotFrames != frames || gotDuration != frames*40 {
+			t.Errorf("scanGIF = %d frames, %d ms, want %d frames, %d ms", gotFrames, gotDuration, frames, frames*40)
+		}
+	}
+}
+
+func TestScanGIFRejectsTruncated(t *testing.T) {
+	data := testGIF(t, 3, 4)
+	path := filepath.Join(t.TempDir(), "truncated.gif")
+	if err := os.WriteFile(path, data[:len(data)-5], 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := scanGIF(path); err == nil {
+		t.Error("scanGIF accepted a truncated GIF")
+	}
+}
+
+func TestConvertRejectsLongAnimation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	savedCfg, savedCapabilities := cfg, serverCapabilities
+	t.Cleanup(func() { cfg, serverCapabilities = savedCfg, savedCapabilities })
+	cfg.MaxAnimFrames = 3
+	serverCapabilities.Animated = true
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("image", "anim.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(testGIF(t, 5, 10))
+	form.Close()
+
+	router := gin.New()
+	router.POST("/convert", convertToWebP)
+	req := httptest.NewRequest(http.MethodPost, "/convert", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want 422; body %s", recorder.Code, recorder.Body)
+	}
+	var got struct {
+		FrameCount int `json:"frameCount"`
+		DurationMs int `json:"durationMs"`
+		MaxFrames  int `json:"maxFrames"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.FrameCount != 5 || got.DurationMs != 500 || got.MaxFrames != 3 {
+		t.Errorf("body = %s, want frameCount 5, durationMs 500, maxFrames 3", recorder.Body)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// gzipContentTypes lists the response media types worth compressing.
+// Image payloads (image/webp, image/avif, ...) are already compressed and
+// are deliberately left out. application/zip is included because the only
+// archive served, the responsive set, is written uncompressed (zip.Store).
+var gzipContentTypes = []string{
+	"application/json",
+	"application/zip",
+	"text/plain",
+}
+
+// gzipResponseWriter defers the compression decision until the first write,
+// when the handler has set the final Content-Type.
+type gzipResponseWriter struct {
+	gin.ResponseWriter
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipResponseWriter) decide() {
+	if w.decided {
+		return
+	}
+	w.decided = true
+
+	status := w.ResponseWriter.Status()
+	if status == http.StatusNoContent || status == http.StatusNotModified {
+		return
+	}
+	if w.Header().Get("Content-Encoding") != "" {
+		return
+	}
+	if !isGzipContentType(w.Header().Get("Content-Type")) {
+		return
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Del("Content-Length")
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	w.decide()
+	if w.gz == nil {
+		return w.ResponseWriter.Write(data)
+	}
+	return w.gz.Write(data)
+}
+
+func (w *gzipResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush pushes any buffered compressed data to the client.
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// gzipMiddleware compresses JSON, text and uncompressed ZIP responses for
+// clients that accept gzip. Binary image responses are passed through
+// untouched.
+func gzipMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !acceptsGzip(c.Request.Header.Get("Accept-Encoding")) {
+			c.Next()
+			return
+		}
+
+		writer := &gzipResponseWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		defer func() {
+			if writer.gz != nil {
+				writer.gz.Close()
+			}
+		}()
+
+		c.Next()
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		// "gzip;q=0" explicitly refuses the encoding
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			return strings.Trim(q, "0.") != ""
+		}
+		return true
+	}
+	return false
+}
+
+// isGzipContentType reports whether a Content-Type is in gzipContentTypes
+func isGzipContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range gzipContentTypes {
+		if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
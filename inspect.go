@@ -0,0 +1,55 @@
+package main
+
+import (
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// readImageConfig decodes only the header of an image file, returning its
+// dimensions and detected format without decoding the pixel data
+func readImageConfig(path string) (image.Config, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Config{}, "", err
+	}
+	defer f.Close()
+
+	return image.DecodeConfig(f)
+}
+
+// detectFormat identifies an input file from its content: "svg", a Go
+// image format name such as "jpeg" or "png", a videoFormat container, or
+// "" when unrecognized
+func detectFormat(path string) string {
+	if isSVG(path) {
+		return "svg"
+	}
+	if format := videoFormat(path); format != "" {
+		return format
+	}
+	_, format, err := readImageConfig(path)
+	if err != nil {
+		return ""
+	}
+	return format
+}
+
+// verifyImage fully decodes an image file, reporting any error in the pixel
+// data that a header-only read would miss
+func verifyImage(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, _, err = image.Decode(f)
+	return err
+}
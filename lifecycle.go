@@ -0,0 +1,29 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// conversionCount is the number of cwebp conversions this process has run
+var conversionCount atomic.Int64
+
+// recycle is closed once MAX_CONVERSIONS_BEFORE_EXIT is reached, telling
+// main to shut down gracefully so the orchestrator starts a fresh process
+var (
+	recycle     = make(chan struct{})
+	recycleOnce sync.Once
+)
+
+// recordConversion counts a completed conversion and requests a recycle
+// when the configured limit is hit
+func recordConversion() {
+	n := conversionCount.Add(1)
+	if cfg.MaxConversionsBeforeExit > 0 && n >= int64(cfg.MaxConversionsBeforeExit) {
+		recycleOnce.Do(func() {
+			log.Printf("Reached %d conversions, recycling process", n)
+			close(recycle)
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openLocalUpload opens a server-side file named by a JSON request's
+// "path", for trusted deployments that share a volume with their clients.
+// Relative paths are taken from LOCAL_PATH_BASE, and the resolved path,
+// symlinks included, must stay inside it.
+func openLocalUpload(name string) (*upload, *httpError) {
+	if !cfg.AllowLocalPaths {
+		return nil, &httpError{http.StatusForbidden, gin.H{"error": "Local paths are disabled"}}
+	}
+
+	path, err := resolveLocalPath(cfg.LocalPathBase, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, &httpError{http.StatusNotFound, gin.H{"error": "File not found"}}
+	}
+	if err != nil {
+		return nil, &httpError{http.StatusForbidden, gin.H{"error": "Path is outside the allowed directory"}}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, &httpError{http.StatusNotFound, gin.H{"error": "File not found"}}
+	}
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		f.Close()
+		return nil, &httpError{http.StatusBadRequest, gin.H{"error": "Path is not a regular file"}}
+	}
+	if info.Size() == 0 {
+		f.Close()
+		return nil, emptyUpload()
+	}
+	if cfg.MaxUploadBytes > 0 && info.Size() > cfg.MaxUploadBytes {
+		f.Close()
+		return nil, uploadTooLarge()
+	}
+	return &upload{Reader: f, name: filepath.Base(path), size: info.Size(), close: f.Close}, nil
+}
+
+// errOutsideBase is returned for paths that resolve outside the base
+// directory
+var errOutsideBase = errors.New("path escapes the base directory")
+
+// resolveLocalPath resolves name against base, following symlinks, and
+// fails unless the result is inside base
+func resolveLocalPath(base, name string) (string, error) {
+	root, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		return "", err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(root, name)
+	}
+	// Checking before resolving too keeps "not found" from revealing what
+	// exists outside base
+	if !isInsideDir(root, filepath.Clean(name)) {
+		return "", errOutsideBase
+	}
+	resolved, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return "", err
+	}
+	if !isInsideDir(root, resolved) {
+		return "", errOutsideBase
+	}
+	return resolved, nil
+}
+
+// isInsideDir reports whether path is dir or below it
+func isInsideDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
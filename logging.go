@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// logStartKey holds the request start time for the sampling decision
+const logStartKey = "logStart"
+
+// requestLogger is gin's request logger, writing only one in LOG_SAMPLE_RATE
+// successful requests. Errors and requests slower than LOG_SLOW_THRESHOLD
+// are always logged.
+func requestLogger() gin.HandlerFunc {
+	if cfg.LogSampleRate <= 1 {
+		return gin.Logger()
+	}
+
+	var count atomic.Uint64
+	logger := gin.LoggerWithConfig(gin.LoggerConfig{
+		Skip: func(c *gin.Context) bool {
+			if responseStatus(c) >= http.StatusBadRequest || time.Since(c.GetTime(logStartKey)) >= cfg.LogSlowThreshold {
+				return false
+			}
+			return count.Add(1)%uint64(cfg.LogSampleRate) != 0
+		},
+	})
+
+	return func(c *gin.Context) {
+		c.Set(logStartKey, time.Now())
+		logger(c)
+	}
+}
@@ -1,28 +1,73 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func main() {
-	router := gin.Default()
+	cfg = loadConfig()
+	if err := validateDefaultOptions(cfg.DefaultOptions); err != nil {
+		log.Fatalf("Invalid default options in CONFIG_FILE: %s", strings.Join(err.(*optionsError).problems, "; "))
+	}
+	logEffectiveConfig(cfg)
+	if cfg.AllowLocalPaths && cfg.LocalPathBase == "" {
+		log.Fatal("ALLOW_LOCAL_PATHS requires LOCAL_PATH_BASE")
+	}
+	if !validDuplicatePolicy(cfg.MultipartDuplicatePolicy) {
+		log.Fatalf("Invalid MULTIPART_DUPLICATE_POLICY %q, must be first, strict or batch", cfg.MultipartDuplicatePolicy)
+	}
+	detectSVGRasterizer()
+	detectCapabilities()
+
+	if cfg.CacheDir != "" {
+		cache, err := newDiskCache(cfg.CacheDir, cfg.CacheMaxBytes)
+		if err != nil {
+			log.Fatalf("Failed to open cache directory: %v", err)
+		}
+		resultCache = cache
+	}
+
+	shutdownTracing, err := initTracing(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to initialize tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	router := gin.New()
+	router.Use(requestLogger(), gin.Recovery())
+	router.Use(tracingMiddleware())
+	router.Use(requestMetricsMiddleware())
 
 	//TODO remove after adding domain
 	// CORS middleware
 	router.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
-		c.Header("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type")
+		c.Header("Access-Control-Allow-Methods", "GET, POST, PATCH, HEAD, DELETE, OPTIONS")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Content-Encoding, Authorization, X-API-Key, Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata")
+		c.Header("Access-Control-Expose-Headers", exposedHeaders)
 
 		if c.Request.Method == "OPTIONS" {
+			if uploads != nil && isTusPath(c.Request.URL.Path) {
+				tusDiscoveryHeaders(c)
+			}
 			c.AbortWithStatus(http.StatusNoContent)
 			return
 		}
@@ -30,7 +75,11 @@ func main() {
 		c.Next()
 	})
 
-	// Set max upload size (10 MB)
+	// Compress JSON responses; WebP output is passed through as-is
+	router.Use(gzipMiddleware())
+
+	// Buffer up to 10 MB of multipart data in memory; the upload size
+	// itself is capped by MAX_UPLOAD_BYTES
 	router.MaxMultipartMemory = 10 << 20
 
 	// Health check endpoint
@@ -38,70 +87,751 @@ func main() {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
 
+	// Optional features available on this host
+	router.GET("/capabilities", getCapabilities)
+
+	// Machine-readable description of this API
+	router.GET("/openapi.json", getOpenAPI)
+
 	// Convert and return WebP directly
-	router.POST("/convert", convertToWebP)
+	convertHandlers := []gin.HandlerFunc{apiKeyAuth(), requestBodyMiddleware()}
+	if cfg.QuotaLimit > 0 {
+		convertHandlers = append(convertHandlers, quotaMiddleware(newConversionQuota(cfg.QuotaLimit, cfg.QuotaWindow)))
+	}
+	if cfg.MaxConcurrentConversions > 0 {
+		slots = newConversionSlots(cfg.MaxConcurrentConversions, cfg.PriorityAging)
+		convertHandlers = append(convertHandlers, concurrencyMiddleware(slots))
+	}
+	router.POST("/convert", append(convertHandlers, convertToWebP)...)
+
+	// Convert while reporting progress as Server-Sent Events, ending with
+	// a link to download the result
+	if store, err := newResultStore(filepath.Join(os.TempDir(), "webp-results"), cfg.ResultTTL); err != nil {
+		log.Printf("Progress streaming disabled: %v", err)
+	} else {
+		results = store
+	}
+	router.POST("/convert/stream", append(convertHandlers, convertStream)...)
+	router.GET("/convert/results/:id", apiKeyAuth(), downloadResult)
+
+	// Report PSNR/SSIM of the WebP against its source, for picking quality
+	router.POST("/compare-quality", append(convertHandlers, compareQuality)...)
+
+	// Return whichever of WebP, AVIF and the original is smallest
+	router.POST("/optimize", append(convertHandlers, optimizeImage)...)
+
+	// Resumable uploads (tus protocol), converted once complete. HEAD on
+	// the convert URL reports the result's size without sending it.
+	if store, err := newTusStore(cfg.UploadDir, cfg.UploadTTL); err != nil {
+		log.Printf("Resumable uploads disabled: %v", err)
+	} else {
+		uploads = store
+		go uploads.sweepLoop()
+
+		tus := router.Group("/uploads", apiKeyAuth(), requireTusResumable())
+		tus.POST("", createUpload)
+		tus.HEAD("/:id", headUpload)
+		tus.PATCH("/:id", patchUpload)
+		tus.DELETE("/:id", deleteUpload)
+		router.POST("/uploads/:id/convert", append(convertHandlers, convertUpload)...)
+		router.HEAD("/uploads/:id/convert", append(convertHandlers, convertUpload)...)
+	}
+
+	// Conversion metrics in Prometheus text format
+	router.GET("/metrics", serveMetrics)
+
+	// Operator endpoints
+	admin := router.Group("/admin", adminAuth())
+	admin.GET("/maintenance", getMaintenance)
+	admin.POST("/maintenance", setMaintenance)
+	admin.POST("/cache/purge", purgeCache)
+
+	// Runtime profiling, off unless explicitly enabled
+	if cfg.EnablePprof {
+		registerPprof(router)
+		log.Println("Profiling enabled at /debug/pprof")
+	}
+
+	server := &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           router,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	server.SetKeepAlivesEnabled(cfg.KeepAlives)
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	go func() {
+		log.Printf("Starting server on port %s", cfg.Port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed: %v", err)
+		}
+	}()
+
+	// Stop on SIGINT/SIGTERM or once the conversion limit is reached,
+	// letting in-flight requests finish first
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down", sig)
+	case <-recycle:
 	}
 
-	log.Printf("Starting server on port %s", port)
-	router.Run(":" + port)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Graceful shutdown failed: %v", err)
+	}
 }
 
 // convertToWebP handles image upload and converts it to WebP format
 func convertToWebP(c *gin.Context) {
-	// Get the uploaded file
-	file, header, err := c.Request.FormFile("image")
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No image file provided"})
+	if maintenanceMode.Load() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Conversions are paused for maintenance, try again later"})
+		return
+	}
+
+	// Several images in one upload are converted one by one under the
+	// batch policy
+	files, batchErr := batchImages(c)
+	if batchErr != nil {
+		batchErr.respond(c)
+		return
+	}
+	if files != nil {
+		convertBatch(c, files)
+		return
+	}
+
+	ctx := c.Request.Context()
+	c.Set(conversionStartKey, time.Now())
+
+	// Each pipeline stage gets its own span; ending an already ended span
+	// is a no-op, so this covers early returns from any stage
+	_, span := tracer.Start(ctx, "upload.read")
+	defer func() { span.End() }()
+
+	file, uploadErr := openUpload(c)
+	if uploadErr != nil {
+		uploadErr.respond(c)
 		return
 	}
 	defer file.Close()
+	// filename= names the download in place of the upload; the extension
+	// is still always the output's
+	if name := c.Query("filename"); name != "" {
+		file.name = name
+	}
+
+	opts, err := parseOptions(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":    "Invalid conversion options",
+			"problems": err.(*optionsError).problems,
+		})
+		return
+	}
+
+	// no_cache=true keeps sensitive images out of the result cache and
+	// asks clients and proxies not to store the response either
+	useCache := resultCache != nil
+	if c.Query("no_cache") == "true" {
+		useCache = false
+		c.Header("Cache-Control", "no-store, private")
+	}
 
 	// Create a temporary directory for processing
-	tempDir, err := os.MkdirTemp("", "webp-convert-*")
+	tempDir, err := createTempDir()
+	if respondDiskFull(c, err) {
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create temp directory"})
 		return
 	}
 	defer os.RemoveAll(tempDir)
 
+	// Streamed uploads go straight into cwebp when nothing else needs to
+	// look at the file; the rest are saved like any other upload
+	if file.size < 0 {
+		sniffed := bufio.NewReaderSize(file.Reader, streamSniffLen)
+		file.Reader = sniffed
+		if canStream(c, opts, useCache) {
+			span.End()
+			if streamUpload(c, file, sniffed, opts, tempDir) {
+				return
+			}
+		}
+	}
+
 	// Save the uploaded file temporarily
-	inputPath := filepath.Join(tempDir, header.Filename)
-	inputFile, err := os.Create(inputPath)
+	inputPath := filepath.Join(tempDir, sanitizeFilename(file.name))
+	inputFile, err := createPrivateFile(inputPath)
+	if respondDiskFull(c, err) {
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save uploaded file"})
 		return
 	}
 
-	_, err = io.Copy(inputFile, file)
-	inputFile.Close()
+	// Hash the upload while saving it, for the cache key
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(inputFile, hasher), file)
+	if closeErr := inputFile.Close(); err == nil {
+		err = closeErr
+	}
+	if isBodyTooLarge(err) {
+		uploadTooLarge().respond(c)
+		return
+	}
+	if respondDiskFull(c, err) {
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to copy uploaded file"})
 		return
 	}
+	if written == 0 {
+		emptyUpload().respond(c)
+		return
+	}
+	if file.size < 0 {
+		file.size = written
+	}
+	c.Set(inputBytesKey, file.size)
+	inputHash := hasher.Sum(nil)
+	if isDenylisted(inputHash) {
+		log.Printf("Rejected denylisted upload %x", inputHash)
+		rejectDenylisted(c)
+		return
+	}
+	// Preprocessing steps replace inputPath; keep the upload itself for
+	// passthrough
+	uploadPath := inputPath
+	span.SetAttributes(attribute.Int64("upload.size", file.size))
+	span.End()
+	reportStage(c, "received")
+
+	// Record every conversion attempt against the detected input format.
+	// outputSize stays 0 for failures.
+	start := time.Now()
+	inputFormat, outputSize := detectFormat(inputPath), 0
+	defer func() {
+		success := c.Writer.Status() < http.StatusBadRequest
+		metrics.observe(inputFormat, success, file.size, int64(outputSize), time.Since(start))
+	}()
+
+	_, span = tracer.Start(ctx, "input.validate")
+	reportStage(c, "validating")
+
+	// Formats that decode to far more than their file size can have
+	// tighter limits than the global MAX_UPLOAD_BYTES
+	if limit := uploadLimit(inputFormat); limit > 0 && file.size > limit {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error":    "Upload exceeds the maximum allowed size for this format",
+			"format":   inputFormat,
+			"maxBytes": limit,
+		})
+		return
+	}
+
+	// cwebp can't read SVG, so rasterize it to PNG first
+	if inputFormat == "svg" {
+		if svgRasterizer == "" {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{
+				"error":   "SVG input is not supported by this server",
+				"details": "Convert the SVG to PNG before uploading, or install rsvg-convert or resvg on the server",
+			})
+			return
+		}
+		// A dimension left to the aspect ratio can be huge for a very
+		// wide or tall SVG, so both are bounded before anything renders
+		width, height := svgRenderSize(inputPath, opts.Width, opts.Height)
+		if exceedsMaxPixels(width, height) || width > maxSVGDimension || height > maxSVGDimension {
+			rejectOversized(c, width, height)
+			return
+		}
+
+		rasterPath, output, err := rasterizeSVG(ctx, inputPath, opts.Width, opts.Height)
+		if respondDiskFull(c, err) {
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":   "Failed to rasterize SVG",
+				"details": rasterizeErrorDetails(output),
+			})
+			return
+		}
+		inputPath = rasterPath
+	}
+
+	// Video becomes a poster image: the frame at ?timestamp= seconds
+	if isVideoFormat(inputFormat) {
+		if !serverCapabilities.Video {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{
+				"error":   "Video input is not supported by this server",
+				"details": "Extract a frame to PNG or JPEG before uploading, or install ffmpeg on the server",
+			})
+			return
+		}
+
+		framePath, output, err := extractVideoFrame(ctx, inputPath, opts.Timestamp)
+		if errors.Is(err, errNoVideoFrame) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "timestamp is past the end of the video"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":   "Failed to extract video frame",
+				"details": videoErrorDetails(output),
+			})
+			return
+		}
+		inputPath = framePath
+	}
+
+	// Reject images whose decoded size would exhaust memory. Formats Go
+	// can't parse are left for cwebp to accept or reject.
+	imgConfig, format, err := readImageConfig(inputPath)
+	if err == nil && exceedsMaxPixels(imgConfig.Width, imgConfig.Height) {
+		rejectOversized(c, imgConfig.Width, imgConfig.Height)
+		return
+	}
+	if err == nil {
+		applyQualityTier(&opts, imgConfig.Width, imgConfig.Height)
+	}
+
+	// Neither cwebp nor the other libwebp tools can re-encode an animated
+	// WebP without flattening it to one frame, so it's returned as uploaded
+	if format == "webp" && isAnimatedWebP(inputPath) {
+		if opts.Static {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "static isn't supported for animated WebP input"})
+			return
+		}
+		data, err := os.ReadFile(uploadPath)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read uploaded file"})
+			return
+		}
+		outputSize = len(data)
+		if exceedsOutputLimit(c, opts, len(data)) {
+			return
+		}
+		span.End()
+
+		_, span = tracer.Start(ctx, "response.write")
+		c.Header("Warning", `199 - "animated WebP returned unchanged, re-encoding would drop the animation"`)
+		sendWebP(c, renderFilename(cfg.FilenameTemplate, file.name, inputHash, time.Now()), data, tempDir)
+		return
+	}
+
+	// verify=true decodes the whole image rather than just the header, to
+	// catch truncated or corrupt uploads that cwebp might half-accept
+	if c.Query("verify") == "true" {
+		if err := verifyImage(inputPath); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":   "Image is corrupt or truncated",
+				"details": err.Error(),
+			})
+			return
+		}
+	}
 
-	// Get the output filename (same name but with .webp extension)
-	outputFilename := filenameWithoutExt(header.Filename) + ".webp"
+	// cwebp can't read GIF: animations go through gif2webp, while still
+	// images (or the chosen frame when static=true) are flattened to PNG
+	animated := false
+	if format == "gif" {
+		// The frames are counted without decoding them, so that the limits
+		// below are enforced before DecodeAll holds every frame in memory
+		frames, durationMs, err := scanGIF(inputPath)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Failed to decode GIF"})
+			return
+		}
+		c.Header("X-Frame-Count", strconv.Itoa(frames))
+
+		if frames > 1 && !opts.Static {
+			if !serverCapabilities.Animated {
+				c.JSON(http.StatusUnsupportedMediaType, gin.H{
+					"error":   "Animated GIF output is not supported by this server",
+					"details": "Add static=true to convert a single frame, or install gif2webp on the server",
+				})
+				return
+			}
+			if opts.Blur > 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "blur isn't supported for animations, add static=true"})
+				return
+			}
+			if opts.SSIM > 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "ssim isn't supported for animations, add static=true"})
+				return
+			}
+			// gif2webp's time and memory grow with the frame count, so long
+			// animations get the same kind of guard as MAX_PIXELS
+			if exceedsAnimationLimits(frames, durationMs) {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{
+					"error":         "Animation exceeds the maximum allowed length",
+					"frameCount":    frames,
+					"durationMs":    durationMs,
+					"maxFrames":     cfg.MaxAnimFrames,
+					"maxDurationMs": cfg.MaxAnimDurationMs,
+				})
+				return
+			}
+			animated = true
+		}
+
+		anim, err := decodeGIF(inputPath)
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Failed to decode GIF"})
+			return
+		}
+		if !animated {
+			if opts.frame() >= len(anim.Image) {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error":      "frame is out of range",
+					"frameCount": len(anim.Image),
+				})
+				return
+			}
+			framePath := inputPath + ".frame.png"
+			if err := writePNG(framePath, gifFrame(anim, opts.frame())); err != nil {
+				if respondDiskFull(c, err) {
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to extract GIF frame"})
+				return
+			}
+			inputPath = framePath
+		}
+	}
+
+	// cwebp ignores EXIF orientation, so rotate the pixels upright unless
+	// the client asked to keep the tag instead. The tag only survives when
+	// cwebp reads the JPEG itself: CMYK conversion and blur go through a PNG
+	// without EXIF, so those rotate the pixels after all.
+	orient := opts.Orient
+	if orient == orientKeepTag && format == "jpeg" && (opts.Blur > 0 || isCMYKJPEG(inputPath)) {
+		orient = orientRotatePixels
+		if jpegOrientation(inputPath) != 1 {
+			c.Header("Warning", `199 - "orientation applied to the pixels, blur and CMYK conversion can't keep the EXIF tag"`)
+		}
+	}
+	if orient == orientKeepTag && format == "jpeg" {
+		c.Set(keptOrientationKey, jpegOrientation(inputPath))
+	}
+	if orient == orientRotatePixels {
+		orientedPath, err := orientFile(inputPath)
+		if respondDiskFull(c, err) {
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Failed to decode image for orientation"})
+			return
+		}
+		inputPath = orientedPath
+	}
+
+	// cwebp mangles the colors of CMYK JPEGs from print workflows, so
+	// convert them to RGB first. Rotated JPEGs are already RGB by now.
+	if isCMYKJPEG(inputPath) {
+		log.Printf("Converting CMYK JPEG %s to RGB before encoding", file.name)
+		rgbPath, err := cmykToRGBFile(inputPath)
+		if respondDiskFull(c, err) {
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Failed to decode CMYK JPEG"})
+			return
+		}
+		inputPath = rgbPath
+	}
+
+	// Blur the source ahead of cwebp, e.g. for low-quality placeholders
+	if opts.Blur > 0 {
+		blurredPath, err := blurFile(inputPath, opts.Blur)
+		if respondDiskFull(c, err) {
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Failed to decode image for blurring"})
+			return
+		}
+		inputPath = blurredPath
+	}
+
+	// Get the output filename (by default the same name with a .webp extension)
+	outputFilename := renderFilename(cfg.FilenameTemplate, file.name, inputHash, time.Now())
 	outputPath := filepath.Join(tempDir, outputFilename)
 
-	// Get quality parameter (default: 80)
-	quality := c.DefaultQuery("quality", "80")
+	// The prepared input, decoded at most once for the modes that need its
+	// pixels
+	source := newSourceImage(inputPath)
+
+	span.End()
+	reportStage(c, "converting")
+
+	// /compare-quality encodes once and reports PSNR and SSIM against the
+	// encoder input, bypassing the result cache
+	if c.GetBool(compareContextKey) {
+		if animated || len(opts.Widths) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Only single still images can be compared"})
+			return
+		}
+
+		_, span = tracer.Start(ctx, "cwebp.exec", trace.WithAttributes(attribute.String("encoder", "compare")))
+		output, err := runCwebp(ctx, opts.cwebpFlags(), inputPath, outputPath)
+		if err != nil {
+			if respondDiskFull(c, err) {
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to convert image",
+				"details": cwebpErrorDetails(output),
+			})
+			return
+		}
+		recordConversion()
+		webpData, err := os.ReadFile(outputPath)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read converted file"})
+			return
+		}
+		outputSize = len(webpData)
+		span.End()
+
+		_, span = tracer.Start(ctx, "response.write")
+		respondComparison(c, source, webpData)
+		return
+	}
+
+	// widths= encodes a responsive set, one WebP per width, which bypasses
+	// the result cache
+	if len(opts.Widths) > 0 {
+		if animated {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "widths isn't supported for animations, add static=true"})
+			return
+		}
+
+		_, span = tracer.Start(ctx, "cwebp.exec", trace.WithAttributes(attribute.Int("responsive.widths", len(opts.Widths))))
+		images, output, err := encodeResponsiveSet(c, opts, source, tempDir, outputFilename)
+		if err != nil {
+			if respondDiskFull(c, err) {
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to convert image",
+				"details": cwebpErrorDetails(output),
+			})
+			return
+		}
+		recordConversion()
+		for _, img := range images {
+			outputSize += len(img.data)
+			if exceedsOutputLimit(c, opts, len(img.data)) {
+				return
+			}
+		}
+		span.End()
+
+		_, span = tracer.Start(ctx, "response.write")
+		respondResponsiveSet(c, outputFilename, images)
+		return
+	}
+
+	// /optimize encodes every available format and keeps the smallest,
+	// bypassing the result cache
+	if c.GetBool(optimizeContextKey) {
+		_, span = tracer.Start(ctx, "cwebp.exec", trace.WithAttributes(attribute.String("encoder", "optimize")))
+		candidates, output, err := optimizeCandidates(ctx, opts, source, uploadPath, inputFormat, outputFilename, file.name, animated)
+		if err != nil {
+			if respondDiskFull(c, err) {
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to convert image",
+				"details": cwebpErrorDetails(output),
+			})
+			return
+		}
+		recordConversion()
+		best := smallestCandidate(candidates)
+		outputSize = len(best.data)
+		if exceedsOutputLimit(c, opts, len(best.data)) {
+			return
+		}
+		span.SetAttributes(attribute.String("optimize.chosen", best.format))
+		span.End()
+
+		_, span = tracer.Start(ctx, "response.write")
+		c.Header("X-Chosen-Format", best.format)
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", best.filename))
+		c.Data(http.StatusOK, best.contentType, best.data)
+		return
+	}
+
+	// auto_format=true picks the output format from the Accept header, for
+	// use as a content-negotiating image proxy. JSON responses always carry
+	// WebP.
+	if c.Query("auto_format") == "true" && !wantsJSON(c) {
+		c.Writer.Header().Add("Vary", "Accept")
+		chosen := negotiateFormat(c.GetHeader("Accept"), inputFormat)
+		if chosen == formatAVIF && animated {
+			chosen = formatWebP
+		}
+
+		switch chosen {
+		case formatOriginal:
+			data, err := os.ReadFile(uploadPath)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read uploaded file"})
+				return
+			}
+			outputSize = len(data)
+			if exceedsOutputLimit(c, opts, len(data)) {
+				return
+			}
+			c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", forceExtension(file.name, formatExtension(inputFormat))))
+			c.Data(http.StatusOK, "image/"+inputFormat, data)
+			return
+		case formatAVIF:
+			_, span = tracer.Start(ctx, "cwebp.exec", trace.WithAttributes(attribute.String("encoder", "avifenc")))
+			data, output, err := encodeAVIF(ctx, opts, source)
+			if err != nil {
+				if respondDiskFull(c, err) {
+					return
+				}
+				c.JSON(http.StatusInternalServerError, gin.H{
+					"error":   "Failed to convert image",
+					"details": cwebpErrorDetails(output),
+				})
+				return
+			}
+			recordConversion()
+			outputSize = len(data)
+			if exceedsOutputLimit(c, opts, len(data)) {
+				return
+			}
+			span.End()
+
+			_, span = tracer.Start(ctx, "response.write")
+			c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", avifFilename(outputFilename)))
+			c.Data(http.StatusOK, "image/avif", data)
+			return
+		}
+	}
+
+	encoder, flags := "cwebp", opts.cwebpFlags()
+	if animated {
+		encoder, flags = "gif2webp", opts.gif2webpFlags()
+	}
+	if cfg.Debug {
+		c.Header("X-Cwebp-Args", strings.Join(flags, " "))
+	}
+
+	key := cacheKey(inputHash, opts)
+
+	// Serve a previous conversion of the same input and options
+	if useCache {
+		if cached, info, ok := resultCache.Get(key); ok {
+			defer cached.Close()
+			outputSize = int(info.Size())
+			if exceedsOutputLimit(c, opts, outputSize) {
+				return
+			}
+			_, span = tracer.Start(ctx, "response.write", trace.WithAttributes(attribute.Bool("cache.hit", true)))
+
+			if wantsJSON(c) {
+				data, err := io.ReadAll(cached)
+				if err != nil {
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read cached file"})
+					return
+				}
+				c.Header("X-Cache", "HIT")
+				c.Header("ETag", responseETag(c, key))
+				respondJSON(c, outputFilename, data, tempDir)
+				return
+			}
+
+			peek := make([]byte, webpHeaderPeek)
+			n, _ := io.ReadFull(cached, peek)
+			if features, err := parseWebPFeatures(peek[:n]); err == nil {
+				setWebPFeatureHeaders(c, features)
+			}
+			cached.Seek(0, io.SeekStart)
+			if c.Query("placeholder_header") == "true" {
+				if data, err := io.ReadAll(cached); err == nil {
+					setPlaceholderHeader(c, data, tempDir)
+				}
+				cached.Seek(0, io.SeekStart)
+			}
+
+			if opts.Mode == modeAuto {
+				c.Header("X-Mode-Chosen", compressionOf(peek[:n]))
+			}
+			c.Header("X-Cache", "HIT")
+			c.Header("X-WebP-Size", strconv.FormatInt(info.Size(), 10))
+			c.Header("Content-Type", "image/webp")
+			c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", outputFilename))
+			c.Header("ETag", responseETag(c, key))
+			http.ServeContent(c.Writer, c.Request, outputFilename, info.ModTime(), cached)
+			return
+		}
+		c.Header("X-Cache", "MISS")
+	}
+
+	// A HEAD probe with cache_only=true asks about existing results without
+	// paying for a conversion
+	if c.Request.Method == http.MethodHead && c.Query("cache_only") == "true" {
+		c.Status(http.StatusNotFound)
+		return
+	}
 
-	// Convert to WebP using cwebp (from apt package)
-	// -resize max_width 0 keeps aspect ratio, only resizes if wider than max_width
-	cmd := exec.Command("cwebp", "-q", quality, "-resize", "1200", "0", inputPath, "-o", outputPath)
-	output, err := cmd.CombinedOutput()
+	_, span = tracer.Start(ctx, "cwebp.exec", trace.WithAttributes(
+		attribute.String("encoder", encoder),
+		attribute.String("cwebp.args", strings.Join(flags, " ")),
+		attribute.Int("webp.quality", opts.quality()),
+	))
+
+	// Convert to WebP using cwebp or gif2webp (from the webp apt package).
+	// mode=auto runs the encoder twice and keeps the smaller output.
+	var output []byte
+	quality := opts.quality()
+	if opts.SSIM > 0 {
+		// Only fresh conversions report the quality; cache hits don't know it
+		quality, output, err = encodeForSSIM(ctx, opts, inputPath, outputPath)
+		if err == nil {
+			c.Header("X-Quality-Chosen", strconv.Itoa(quality))
+		}
+	} else if opts.Mode == modeAuto {
+		flagsFor := Options.cwebpFlags
+		if animated {
+			flagsFor = Options.gif2webpFlags
+		}
+		var chosen string
+		chosen, output, err = encodeSmallest(ctx, encoder, flagsFor, opts, inputPath, outputPath)
+		if err == nil {
+			c.Header("X-Mode-Chosen", chosen)
+		}
+	} else {
+		output, err = runEncoder(ctx, encoder, flags, inputPath, outputPath)
+	}
 	if err != nil {
+		if respondDiskFull(c, err) {
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error":   "Failed to convert image",
-			"details": string(output),
+			"details": cwebpErrorDetails(output),
 		})
 		return
 	}
 
+	recordConversion()
+
 	// Read the converted WebP file
 	webpData, err := os.ReadFile(outputPath)
 	if err != nil {
@@ -109,9 +839,68 @@ func convertToWebP(c *gin.Context) {
 		return
 	}
 
-	// Set response headers and send the WebP file
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", outputFilename))
-	c.Data(http.StatusOK, "image/webp", webpData)
+	if opts.provenance() {
+		if webpData, err = addProvenance(webpData, quality); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add provenance metadata"})
+			return
+		}
+	}
+
+	outputSize = len(webpData)
+	span.SetAttributes(attribute.Int("webp.size", len(webpData)))
+	span.End()
+
+	_, span = tracer.Start(ctx, "response.write")
+
+	if useCache {
+		if err := resultCache.Put(key, webpData); err != nil {
+			log.Printf("Failed to write cache entry: %v", err)
+		}
+	}
+
+	if exceedsOutputLimit(c, opts, len(webpData)) {
+		return
+	}
+	c.Header("ETag", responseETag(c, key))
+	sendWebP(c, outputFilename, webpData, tempDir)
+}
+
+// exceedsAnimationLimits reports whether an animation is over
+// MAX_ANIM_FRAMES or MAX_ANIM_DURATION_MS; a zero limit is not applied
+func exceedsAnimationLimits(frames, durationMs int) bool {
+	return (cfg.MaxAnimFrames > 0 && frames > cfg.MaxAnimFrames) ||
+		(cfg.MaxAnimDurationMs > 0 && durationMs > cfg.MaxAnimDurationMs)
+}
+
+// exposedHeaders lists the response headers browser clients may read
+// cross-origin: the tus protocol headers and everything a conversion
+// reports about its result
+var exposedHeaders = strings.Join([]string{
+	"Location", "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size",
+	"Upload-Offset", "Upload-Length", "Upload-Expires",
+	"Content-Disposition", "ETag", "Retry-After", "Warning",
+	"X-Placeholder", "X-Cache", "X-Chosen-Format", "X-Mode-Chosen", "X-Quality-Chosen",
+	"X-Image-Width", "X-Image-Height", "X-Frame-Count", "X-Cwebp-Args",
+	"X-WebP-Size", "X-WebP-Width", "X-WebP-Height", "X-WebP-Compression", "X-WebP-Alpha", "X-WebP-Animated",
+	"X-Conversion-Warnings", "X-Conversion-Stats-JSON",
+	"X-Quota-Limit", "X-Quota-Remaining", "X-Quota-Reset",
+}, ", ")
+
+// exceedsMaxPixels reports whether an image of the given size is over the
+// MAX_PIXELS limit
+func exceedsMaxPixels(width, height int) bool {
+	return cfg.MaxPixels > 0 && width*height > cfg.MaxPixels
+}
+
+// rejectOversized responds 422 with the offending dimensions and the limit,
+// so clients know how far to downscale before retrying
+func rejectOversized(c *gin.Context, width, height int) {
+	c.JSON(http.StatusUnprocessableEntity, gin.H{
+		"error":     "Image dimensions exceed the maximum allowed",
+		"width":     width,
+		"height":    height,
+		"maxPixels": cfg.MaxPixels,
+	})
 }
 
 // filenameWithoutExt returns the filename without its extension
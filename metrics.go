@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metricFormats are the input format labels conversions are bucketed by;
+// anything else is reported as "other"
+var metricFormats = map[string]bool{
+	"jpeg": true,
+	"png":  true,
+	"gif":  true,
+	"tiff": true,
+	"webp": true,
+}
+
+// formatStats accumulates conversion figures for one input format
+type formatStats struct {
+	successes   int64
+	errors      int64
+	inputBytes  int64
+	outputBytes int64
+	seconds     float64
+}
+
+// conversionMetrics collects per-format conversion statistics, exposed in
+// Prometheus text format on /metrics
+type conversionMetrics struct {
+	mu      sync.Mutex
+	formats map[string]*formatStats
+}
+
+var metrics = &conversionMetrics{formats: make(map[string]*formatStats)}
+
+// metricsFormat maps a detected format to its bounded metrics label
+func metricsFormat(format string) string {
+	if metricFormats[format] {
+		return format
+	}
+	return "other"
+}
+
+// observe records one conversion of the given input format
+func (m *conversionMetrics) observe(format string, success bool, inputBytes, outputBytes int64, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	label := metricsFormat(format)
+	stats, ok := m.formats[label]
+	if !ok {
+		stats = &formatStats{}
+		m.formats[label] = stats
+	}
+
+	if success {
+		stats.successes++
+	} else {
+		stats.errors++
+	}
+	stats.inputBytes += inputBytes
+	stats.outputBytes += outputBytes
+	stats.seconds += elapsed.Seconds()
+}
+
+// latencyBuckets are the Prometheus client's default histogram bucket
+// upper bounds, in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// requestSeries identifies one request latency histogram. endpoint is the
+// route template rather than the path, so upload IDs don't add series.
+type requestSeries struct {
+	endpoint    string
+	statusClass string
+}
+
+// latencyHistogram is a cumulative Prometheus histogram over latencyBuckets
+type latencyHistogram struct {
+	// buckets[i] counts requests no slower than latencyBuckets[i]
+	buckets []int64
+	count   int64
+	sum     float64
+}
+
+// requestMetrics collects request latencies by endpoint and status class
+type requestMetrics struct {
+	mu     sync.Mutex
+	series map[requestSeries]*latencyHistogram
+}
+
+var requestStats = &requestMetrics{series: make(map[requestSeries]*latencyHistogram)}
+
+// observe records one request
+func (m *requestMetrics) observe(endpoint string, status int, elapsed time.Duration) {
+	key := requestSeries{endpoint: endpoint, statusClass: fmt.Sprintf("%dxx", status/100)}
+	seconds := elapsed.Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.series[key]
+	if !ok {
+		h = &latencyHistogram{buckets: make([]int64, len(latencyBuckets))}
+		m.series[key] = h
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// requestMetricsMiddleware times every request for the latency histogram.
+// Requests that matched no route share one endpoint label.
+func requestMetricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		endpoint := c.FullPath()
+		if endpoint == "" {
+			endpoint = "unmatched"
+		}
+		requestStats.observe(endpoint, responseStatus(c), time.Since(start))
+	}
+}
+
+// writeMetrics appends the request latency histograms to a /metrics
+// response
+func (m *requestMetrics) writeMetrics(b *strings.Builder) {
+	m.mu.Lock()
+	keys := make([]requestSeries, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	snapshot := make(map[requestSeries]latencyHistogram, len(keys))
+	for _, key := range keys {
+		h := *m.series[key]
+		h.buckets = append([]int64(nil), h.buckets...)
+		snapshot[key] = h
+	}
+	m.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].endpoint != keys[j].endpoint {
+			return keys[i].endpoint < keys[j].endpoint
+		}
+		return keys[i].statusClass < keys[j].statusClass
+	})
+
+	b.WriteString("# HELP http_request_duration_seconds Request latency by endpoint and status class.\n")
+	b.WriteString("# TYPE http_request_duration_seconds histogram\n")
+	for _, key := range keys {
+		h := snapshot[key]
+		labels := fmt.Sprintf("endpoint=%q,status_class=%q", key.endpoint, key.statusClass)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(b, "http_request_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, strconv.FormatFloat(bound, 'g', -1, 64), h.buckets[i])
+		}
+		fmt.Fprintf(b, "http_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		fmt.Fprintf(b, "http_request_duration_seconds_sum{%s} %s\n", labels, fmt.Sprint(h.sum))
+		fmt.Fprintf(b, "http_request_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+}
+
+// serveMetrics writes the collected metrics in Prometheus text format
+func serveMetrics(c *gin.Context) {
+	metrics.mu.Lock()
+	labels := make([]string, 0, len(metrics.formats))
+	for label := range metrics.formats {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	snapshot := make(map[string]formatStats, len(labels))
+	for _, label := range labels {
+		snapshot[label] = *metrics.formats[label]
+	}
+	metrics.mu.Unlock()
+
+	var b strings.Builder
+	series := func(name string, value func(formatStats) string) {
+		for _, label := range labels {
+			fmt.Fprintf(&b, "%s{format=%q} %s\n", name, label, value(snapshot[label]))
+		}
+	}
+
+	b.WriteString("# HELP webp_conversions_total Conversions by input format and result.\n")
+	b.WriteString("# TYPE webp_conversions_total counter\n")
+	for _, label := range labels {
+		fmt.Fprintf(&b, "webp_conversions_total{format=%q,result=\"success\"} %d\n", label, snapshot[label].successes)
+		fmt.Fprintf(&b, "webp_conversions_total{format=%q,result=\"error\"} %d\n", label, snapshot[label].errors)
+	}
+
+	b.WriteString("# HELP webp_input_bytes_total Uploaded bytes by input format.\n")
+	b.WriteString("# TYPE webp_input_bytes_total counter\n")
+	series("webp_input_bytes_total", func(s formatStats) string { return fmt.Sprint(s.inputBytes) })
+
+	b.WriteString("# HELP webp_output_bytes_total Produced WebP bytes by input format.\n")
+	b.WriteString("# TYPE webp_output_bytes_total counter\n")
+	series("webp_output_bytes_total", func(s formatStats) string { return fmt.Sprint(s.outputBytes) })
+
+	b.WriteString("# HELP webp_conversion_seconds Conversion latency by input format.\n")
+	b.WriteString("# TYPE webp_conversion_seconds summary\n")
+	series("webp_conversion_seconds_sum", func(s formatStats) string { return fmt.Sprint(s.seconds) })
+	series("webp_conversion_seconds_count", func(s formatStats) string { return fmt.Sprint(s.successes + s.errors) })
+
+	if slots != nil {
+		slots.writeMetrics(&b)
+	}
+	requestStats.writeMetrics(&b)
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
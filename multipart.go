@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MULTIPART_DUPLICATE_POLICY values: what to do with a multipart upload
+// carrying more than one "image" field
+const (
+	// duplicateFirst converts the first image and ignores the rest
+	duplicateFirst = "first"
+	// duplicateStrict rejects the request
+	duplicateStrict = "strict"
+	// duplicateBatch converts every image, answering with all the results
+	duplicateBatch = "batch"
+)
+
+// validDuplicatePolicy reports whether policy is a known
+// MULTIPART_DUPLICATE_POLICY
+func validDuplicatePolicy(policy string) bool {
+	return policy == duplicateFirst || policy == duplicateStrict || policy == duplicateBatch
+}
+
+// batchImages returns the images of a multipart upload to convert as a
+// batch: those with more than one "image" field under the batch policy. It
+// returns nil for anything else, which convertToWebP handles as usual.
+// Batches over MAX_BATCH_FILES are rejected with 413, since the whole batch
+// runs on one quota unit and one conversion slot.
+func batchImages(c *gin.Context) ([]*multipart.FileHeader, *httpError) {
+	if cfg.MultipartDuplicatePolicy != duplicateBatch || isJSONRequest(c) {
+		return nil, nil
+	}
+	if _, ok := tusUpload(c); ok {
+		return nil, nil
+	}
+	if _, ok := batchUpload(c); ok {
+		return nil, nil
+	}
+	form, err := c.MultipartForm()
+	if isBodyTooLarge(err) {
+		return nil, uploadTooLarge()
+	}
+	if err != nil {
+		return nil, &httpError{http.StatusBadRequest, gin.H{"error": "No image file provided"}}
+	}
+	files := form.File["image"]
+	if cfg.MaxBatchFiles > 0 && len(files) > cfg.MaxBatchFiles {
+		return nil, &httpError{http.StatusRequestEntityTooLarge, gin.H{
+			"error":    "Too many images in one batch",
+			"count":    len(files),
+			"maxFiles": cfg.MaxBatchFiles,
+		}}
+	}
+	if len(files) > 1 {
+		return files, nil
+	}
+	return nil, nil
+}
+
+// duplicateImages is the strict policy's 400 response
+func duplicateImages(count int) *httpError {
+	return &httpError{http.StatusBadRequest, gin.H{
+		"error": "Multiple image fields provided, send one image per request",
+		"count": count,
+	}}
+}
+
+// batchItem is one image's outcome in a batch response: status and body
+// are what a single-image request would have received, with binary images
+// carried as a conversionResult
+type batchItem struct {
+	Name   string          `json:"name"`
+	Status int             `json:"status"`
+	Body   json.RawMessage `json:"body"`
+}
+
+// batchUploadContextKey carries one image of a batch into convertToWebP in
+// place of the request body
+const batchUploadContextKey = "batchUpload"
+
+// batchUpload returns the batch image handed over by convertBatch, if any
+func batchUpload(c *gin.Context) (*upload, bool) {
+	value, ok := c.Get(batchUploadContextKey)
+	if !ok {
+		return nil, false
+	}
+	u, ok := value.(*upload)
+	return u, ok
+}
+
+// convertBatch converts each image of a multipart upload in turn, like a
+// request of its own with the same options, and responds with all of
+// their results in the order they were sent. Each image runs on its own
+// copy of the context, so that nothing one conversion records (headers,
+// orientation, timings) leaks into the next.
+func convertBatch(c *gin.Context, files []*multipart.FileHeader) {
+	items := make([]batchItem, 0, len(files))
+	for _, header := range files {
+		fc := c.Copy()
+		captured := &capturedResponse{ResponseWriter: c.Writer, header: make(http.Header)}
+		fc.Writer = captured
+		if header.Size == 0 {
+			emptyUpload().respond(fc)
+		} else if file, err := header.Open(); err != nil {
+			fc.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read uploaded file"})
+		} else {
+			fc.Set(batchUploadContextKey, &upload{Reader: file, name: header.Filename, size: header.Size, close: file.Close})
+			convertToWebP(fc)
+		}
+		items = append(items, batchItem{Name: header.Filename, Status: captured.Status(), Body: batchItemBody(captured)})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"results": items})
+}
+
+// batchItemBody returns a captured response as JSON, base64-encoding it
+// into a conversionResult when it is an image
+func batchItemBody(captured *capturedResponse) json.RawMessage {
+	contentType := captured.header.Get("Content-Type")
+	if json.Valid(captured.body) && strings.HasPrefix(contentType, "application/json") {
+		return captured.body
+	}
+
+	filename := ""
+	if _, params, err := mime.ParseMediaType(captured.header.Get("Content-Disposition")); err == nil {
+		filename = params["filename"]
+	}
+	body, _ := json.Marshal(conversionResult{
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        len(captured.body),
+		Data:        base64.StdEncoding.EncodeToString(captured.body),
+	})
+	return body
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// openAPISpec describes the HTTP API. It's maintained by hand, so update it
+// along with any change to the routes, their parameters or responses.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// getOpenAPI serves the OpenAPI 3 spec, for client generation and
+// interactive docs
+func getOpenAPI(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json", openAPISpec)
+}
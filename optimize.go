@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// optimizeContextKey marks a request as coming from /optimize
+const optimizeContextKey = "optimize"
+
+// optimizeCandidate is one encoding considered by /optimize
+type optimizeCandidate struct {
+	format      string
+	contentType string
+	filename    string
+	data        []byte
+}
+
+// optimizeImage runs the /convert pipeline but answers with the smallest of
+// WebP, AVIF (when avifenc is installed) and the original upload
+func optimizeImage(c *gin.Context) {
+	c.Set(optimizeContextKey, true)
+	convertToWebP(c)
+}
+
+// avifFilename swaps the .webp extension of a rendered filename for .avif
+func avifFilename(outputFilename string) string {
+	return forceExtension(outputFilename, ".avif")
+}
+
+// optimizeCandidates encodes the prepared input in every available format.
+// The original upload only competes when it's a format browsers display and
+// preprocessing left its pixels untouched. The encoders run one after the
+// other so a request never uses more than its conversion slot.
+func optimizeCandidates(ctx context.Context, opts Options, source *sourceImage, uploadPath, inputFormat, outputFilename, uploadName string, animated bool) ([]optimizeCandidate, []byte, error) {
+	inputPath := source.path
+	encoder, flags := "cwebp", opts.cwebpFlags()
+	if animated {
+		encoder, flags = "gif2webp", opts.gif2webpFlags()
+	}
+	// Named after the input rather than outputFilename, which an uploaded
+	// .webp would share
+	outputPath := inputPath + ".optimized.webp"
+	if output, err := runEncoder(ctx, encoder, flags, inputPath, outputPath); err != nil {
+		return nil, output, err
+	}
+	webpData, err := os.ReadFile(outputPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	candidates := []optimizeCandidate{{formatWebP, "image/webp", outputFilename, webpData}}
+
+	if serverCapabilities.AVIF && !animated {
+		avifData, output, err := encodeAVIF(ctx, opts, source)
+		source.release()
+		if err != nil {
+			return nil, output, err
+		}
+		candidates = append(candidates, optimizeCandidate{formatAVIF, "image/avif", avifFilename(outputFilename), avifData})
+	}
+
+	if inputPath == uploadPath && (inputFormat == "jpeg" || inputFormat == "png" || inputFormat == "webp") {
+		original, err := os.ReadFile(uploadPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		candidates = append(candidates, optimizeCandidate{formatOriginal, "image/" + inputFormat, forceExtension(uploadName, formatExtension(inputFormat)), original})
+	}
+	return candidates, nil, nil
+}
+
+// smallestCandidate returns the candidate with the fewest bytes, preferring
+// earlier candidates on a tie
+func smallestCandidate(candidates []optimizeCandidate) optimizeCandidate {
+	best := candidates[0]
+	for _, candidate := range candidates[1:] {
+		if len(candidate.data) < len(best.data) {
+			best = candidate
+		}
+	}
+	return best
+}
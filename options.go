@@ -0,0 +1,521 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultQuality is used when the request doesn't set quality
+const defaultQuality = 80
+
+// modeAuto is the mode value that picks the smaller of lossy and lossless
+const modeAuto = "auto"
+
+// defaultResizeWidth is the width single-image output is resized to
+const defaultResizeWidth = 1200
+
+// Options are the per-request encoder settings taken from the query string.
+// Pointer fields distinguish "not set" from an explicit zero value.
+type Options struct {
+	Quality *int `json:"quality,omitempty"`
+	// Lossless selects cwebp's lossless mode
+	Lossless bool `json:"lossless,omitempty"`
+	// NearLossless (0..100, 100 is off) preprocesses for lossless and
+	// implies it
+	NearLossless *int `json:"near_lossless,omitempty"`
+	// TargetSize asks cwebp to search for a lossy quality that produces
+	// this many bytes
+	TargetSize int `json:"target_size,omitempty"`
+	// Z is cwebp's lossless preset level (0 fast .. 9 slowest), which
+	// chooses quality and method itself
+	Z *int `json:"z,omitempty"`
+	// Hint is passed to cwebp's -hint (photo, picture or graph)
+	Hint string `json:"hint,omitempty"`
+	// JPEGLike passes cwebp's -jpeg_like, which tunes lossy compression to
+	// land near the size a JPEG of the same quality would have. Set quality
+	// to the JPEG quality being matched; the WebP is then usually larger
+	// than the plain mode at that quality.
+	JPEGLike bool `json:"jpeg_like,omitempty"`
+	// Blur is the Gaussian blur radius applied before encoding, 0 for none
+	Blur float64 `json:"blur,omitempty"`
+	// Orient selects how EXIF orientation is handled: rotate_pixels or
+	// keep_tag
+	Orient string `json:"orient,omitempty"`
+	// Width and Height set the rasterization size of SVG input; 0 keeps
+	// the aspect ratio from the other dimension
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// NoAlpha drops the alpha channel, flattening transparent areas onto
+	// Background (white unless set). A background implies noalpha.
+	NoAlpha    *bool  `json:"noalpha,omitempty"`
+	Background string `json:"background,omitempty"`
+	// Static converts animated input to a single still image of Frame
+	// (default 0) instead of an animated WebP
+	Static bool `json:"static,omitempty"`
+	Frame  *int `json:"frame,omitempty"`
+	// Timestamp is the position in seconds of the frame taken from video
+	// input
+	Timestamp float64 `json:"timestamp,omitempty"`
+	// SSIM (0..1) searches for the lowest quality reaching this structural
+	// similarity instead of using a fixed quality
+	SSIM float64 `json:"ssim,omitempty"`
+	// Mode auto encodes both lossy and lossless and keeps the smaller
+	Mode string `json:"mode,omitempty"`
+	// Provenance embeds an XMP packet naming this service and the quality;
+	// unset falls back to PROVENANCE
+	Provenance *bool `json:"provenance,omitempty"`
+	// MaxOutputBytes fails the request when the output is larger, 0 for
+	// no limit. It doesn't change the output, so it's left out of the
+	// cache key.
+	MaxOutputBytes int `json:"-"`
+	// Widths requests a responsive set with one WebP per width instead of
+	// a single image
+	Widths []int `json:"widths,omitempty"`
+}
+
+// validHints are the values cwebp accepts for -hint
+var validHints = map[string]bool{
+	"photo":   true,
+	"picture": true,
+	"graph":   true,
+}
+
+// optionsError lists every problem found in a request's options
+type optionsError struct {
+	problems []string
+}
+
+func (e *optionsError) Error() string {
+	return strings.Join(e.problems, "; ")
+}
+
+// queryParser reads typed query parameters, collecting a problem for each
+// value that doesn't parse instead of stopping at the first
+type queryParser struct {
+	c        *gin.Context
+	problems []string
+}
+
+func (p *queryParser) int(name string) *int {
+	value := p.c.Query(name)
+	if value == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		p.problems = append(p.problems, fmt.Sprintf("%s must be an integer", name))
+		return nil
+	}
+	return &n
+}
+
+func (p *queryParser) float(name string) *float64 {
+	value := p.c.Query(name)
+	if value == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		p.problems = append(p.problems, fmt.Sprintf("%s must be a number", name))
+		return nil
+	}
+	return &f
+}
+
+func (p *queryParser) bool(name string) *bool {
+	value := p.c.Query(name)
+	if value == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		p.problems = append(p.problems, fmt.Sprintf("%s must be true or false", name))
+		return nil
+	}
+	return &b
+}
+
+func (p *queryParser) intList(name string) []int {
+	value := p.c.Query(name)
+	if value == "" {
+		return nil
+	}
+	var values []int
+	for _, item := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil {
+			p.problems = append(p.problems, fmt.Sprintf("%s must be a comma-separated list of integers", name))
+			return nil
+		}
+		values = append(values, n)
+	}
+	return values
+}
+
+// options decodes a JSON object of conversion options, using the same field
+// names as the individual query parameters, over the CONFIG_FILE defaults
+func (p *queryParser) options(name string) Options {
+	opts := defaultOptions()
+	value := p.c.Query(name)
+	if value == "" {
+		return opts
+	}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&opts); err != nil {
+		p.problems = append(p.problems, fmt.Sprintf("%s must be a JSON object of conversion options: %v", name, err))
+		return defaultOptions()
+	}
+	return opts
+}
+
+// parseOptions reads the conversion options from the request query and
+// validates them, returning an *optionsError listing every problem. A JSON
+// options parameter supplies defaults that individual parameters override.
+func parseOptions(c *gin.Context) (Options, error) {
+	p := &queryParser{c: c}
+	opts := p.options("options")
+	if quality := p.int("quality"); quality != nil {
+		opts.Quality = quality
+	}
+	if lossless := p.bool("lossless"); lossless != nil {
+		opts.Lossless = *lossless
+	}
+	if nearLossless := p.int("near_lossless"); nearLossless != nil {
+		opts.NearLossless = nearLossless
+	}
+	if size := p.int("target_size"); size != nil {
+		opts.TargetSize = *size
+	}
+	if z := p.int("z"); z != nil {
+		opts.Z = z
+	}
+	if hint := c.Query("hint"); hint != "" {
+		opts.Hint = hint
+	}
+	if jpegLike := p.bool("jpeg_like"); jpegLike != nil {
+		opts.JPEGLike = *jpegLike
+	}
+	if blur := p.float("blur"); blur != nil {
+		opts.Blur = *blur
+	}
+	if orient := c.Query("orient"); orient != "" {
+		opts.Orient = orient
+	}
+	if width := p.int("width"); width != nil {
+		opts.Width = *width
+	}
+	if height := p.int("height"); height != nil {
+		opts.Height = *height
+	}
+	if noAlpha := p.bool("noalpha"); noAlpha != nil {
+		opts.NoAlpha = noAlpha
+	}
+	if background := c.Query("background"); background != "" {
+		opts.Background = background
+	}
+	if static := p.bool("static"); static != nil {
+		opts.Static = *static
+	}
+	if frame := p.int("frame"); frame != nil {
+		opts.Frame = frame
+	}
+	if widths := p.intList("widths"); widths != nil {
+		opts.Widths = widths
+	}
+	if timestamp := p.float("timestamp"); timestamp != nil {
+		opts.Timestamp = *timestamp
+	}
+	if ssim := p.float("ssim"); ssim != nil {
+		opts.SSIM = *ssim
+	}
+	if maxBytes := p.int("max_output_bytes"); maxBytes != nil {
+		opts.MaxOutputBytes = *maxBytes
+	}
+	if mode := c.Query("mode"); mode != "" {
+		opts.Mode = mode
+	}
+
+	if provenance := p.bool("provenance"); provenance != nil {
+		opts.Provenance = provenance
+	}
+	if opts.Provenance == nil {
+		provenance := cfg.Provenance
+		opts.Provenance = &provenance
+	}
+
+	if opts.Orient == "" {
+		opts.Orient = orientRotatePixels
+	}
+	opts.Background = strings.TrimPrefix(strings.ToLower(opts.Background), "#")
+
+	if opts.Quality != nil && *opts.Quality < cfg.MinQuality && cfg.ClampQuality {
+		c.Header("Warning", fmt.Sprintf(`199 - "quality %d raised to the minimum of %d"`, *opts.Quality, cfg.MinQuality))
+		q := cfg.MinQuality
+		opts.Quality = &q
+	}
+	if opts.Quality != nil && cfg.QualitySnap && len(cfg.AllowedQualities) > 0 {
+		q := nearestAllowedQuality(*opts.Quality)
+		opts.Quality = &q
+	}
+
+	problems := p.problems
+	if err := validateOptions(opts); err != nil {
+		problems = append(problems, err.(*optionsError).problems...)
+	}
+	if len(problems) > 0 {
+		return opts, &optionsError{problems: problems}
+	}
+	return opts, nil
+}
+
+// validateOptions checks every range and mutual-exclusion constraint on the
+// options in one place, reporting all violations together
+func validateOptions(o Options) error {
+	var problems []string
+	fail := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	// Ranges
+	if o.Quality != nil && (*o.Quality < 0 || *o.Quality > 100) {
+		fail("quality must be between 0 and 100")
+	}
+	if o.Quality != nil && *o.Quality < cfg.MinQuality {
+		fail("quality must be at least %d", cfg.MinQuality)
+	}
+	if o.Quality != nil && len(cfg.AllowedQualities) > 0 && !slices.Contains(cfg.AllowedQualities, *o.Quality) {
+		fail("quality must be one of %s", joinInts(cfg.AllowedQualities))
+	}
+	if o.NearLossless != nil && (*o.NearLossless < 0 || *o.NearLossless > 100) {
+		fail("near_lossless must be between 0 and 100")
+	}
+	if o.Z != nil && (*o.Z < 0 || *o.Z > 9) {
+		fail("z must be between 0 and 9")
+	}
+	if o.TargetSize < 0 {
+		fail("target_size must be a positive number of bytes")
+	}
+	if o.Hint != "" && !validHints[o.Hint] {
+		fail("hint must be one of photo, picture or graph")
+	}
+	if o.Blur != 0 && (o.Blur < minBlur || o.Blur > maxBlur) {
+		fail("blur must be between %g and %g", minBlur, maxBlur)
+	}
+	if o.Orient != orientRotatePixels && o.Orient != orientKeepTag {
+		fail("orient must be rotate_pixels or keep_tag")
+	}
+	if o.Width < 0 || o.Width > maxSVGDimension {
+		fail("width must be 0 (auto) or between 1 and %d", maxSVGDimension)
+	}
+	if o.Height < 0 || o.Height > maxSVGDimension {
+		fail("height must be 0 (auto) or between 1 and %d", maxSVGDimension)
+	}
+	if o.Background != "" && !isHexColor(o.Background) {
+		fail("background must be a hex RGB color such as ffffff")
+	}
+	if o.Frame != nil && *o.Frame < 0 {
+		fail("frame must not be negative")
+	}
+	if o.Timestamp < 0 {
+		fail("timestamp must not be negative")
+	}
+	if o.SSIM != 0 && (o.SSIM <= 0 || o.SSIM >= 1) {
+		fail("ssim must be between 0 and 1, exclusive")
+	}
+	if o.MaxOutputBytes < 0 {
+		fail("max_output_bytes must be a positive number of bytes")
+	}
+	if o.Mode != "" && o.Mode != modeAuto {
+		fail("mode must be auto")
+	}
+	if len(o.Widths) > maxResponsiveWidths {
+		fail("widths accepts at most %d values", maxResponsiveWidths)
+	}
+	for _, w := range o.Widths {
+		if w < 1 || w > maxResponsiveWidth {
+			fail("widths must be between 1 and %d", maxResponsiveWidth)
+			break
+		}
+	}
+
+	// Conflicts
+	if o.TargetSize > 0 {
+		if o.Lossless {
+			fail("target_size applies to lossy encoding and can't be combined with lossless")
+		}
+		if o.NearLossless != nil {
+			fail("target_size applies to lossy encoding and can't be combined with near_lossless")
+		}
+		if o.Z != nil {
+			fail("target_size applies to lossy encoding and can't be combined with z")
+		}
+	}
+	if o.SSIM != 0 {
+		if o.Quality != nil || o.Lossless || o.NearLossless != nil || o.Z != nil || o.TargetSize > 0 || o.Mode != "" {
+			fail("ssim chooses a lossy quality itself and can't be combined with quality, lossless, near_lossless, z, target_size or mode")
+		}
+		if len(o.Widths) > 0 {
+			fail("ssim can't be combined with widths")
+		}
+	}
+	if o.Mode == modeAuto {
+		if o.Lossless || o.NearLossless != nil || o.Z != nil || o.TargetSize > 0 {
+			fail("mode=auto chooses between lossy and lossless itself and can't be combined with lossless, near_lossless, z or target_size")
+		}
+		if len(o.Widths) > 0 {
+			fail("mode=auto can't be combined with widths")
+		}
+	}
+	if o.JPEGLike && (o.Lossless || o.NearLossless != nil || o.Z != nil) {
+		fail("jpeg_like applies to lossy encoding and can't be combined with lossless, near_lossless or z")
+	}
+	if o.Z != nil && o.Quality != nil {
+		fail("z selects its own quality and can't be combined with quality")
+	}
+	if o.Background != "" && o.NoAlpha != nil && !*o.NoAlpha {
+		fail("background flattens transparency and can't be combined with noalpha=false")
+	}
+	if o.Frame != nil && !o.Static {
+		fail("frame selects the still image for static=true and requires it")
+	}
+
+	if len(problems) > 0 {
+		return &optionsError{problems: problems}
+	}
+	return nil
+}
+
+// isHexColor reports whether s is a six digit lowercase hex color
+func isHexColor(s string) bool {
+	if len(s) != 6 {
+		return false
+	}
+	for _, r := range s {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// nearestAllowedQuality returns the ALLOWED_QUALITIES value closest to q,
+// preferring the higher one on a tie. Values under MIN_QUALITY are skipped
+// when any allowed value meets it, so snapping never lands below the floor.
+func nearestAllowedQuality(q int) int {
+	candidates := cfg.AllowedQualities
+	if floor := slices.DeleteFunc(slices.Clone(candidates), func(v int) bool { return v < cfg.MinQuality }); len(floor) > 0 {
+		candidates = floor
+	}
+	best := candidates[0]
+	for _, allowed := range candidates[1:] {
+		d, bestD := abs(allowed-q), abs(best-q)
+		if d < bestD || (d == bestD && allowed > best) {
+			best = allowed
+		}
+	}
+	return best
+}
+
+// constrainQuality fits a quality the server chose itself (the default or
+// a QUALITY_TIERS value) to MIN_QUALITY and ALLOWED_QUALITIES, which apply
+// to it regardless of CLAMP_QUALITY and QUALITY_SNAP
+func constrainQuality(q int) int {
+	q = max(q, cfg.MinQuality)
+	if len(cfg.AllowedQualities) > 0 {
+		q = nearestAllowedQuality(q)
+	}
+	return q
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// joinInts formats a list of integers for an error message
+func joinInts(values []int) string {
+	items := make([]string, len(values))
+	for i, v := range values {
+		items[i] = strconv.Itoa(v)
+	}
+	return strings.Join(items, ", ")
+}
+
+// quality returns the requested quality or the default, constrained like
+// any quality the server picks
+func (o Options) quality() int {
+	if o.Quality != nil {
+		return *o.Quality
+	}
+	return constrainQuality(defaultQuality)
+}
+
+// provenance reports whether the output gets an XMP provenance packet
+func (o Options) provenance() bool {
+	return o.Provenance != nil && *o.Provenance
+}
+
+// noAlpha reports whether the alpha channel is to be dropped
+func (o Options) noAlpha() bool {
+	return o.Background != "" || (o.NoAlpha != nil && *o.NoAlpha)
+}
+
+// cwebpFlags builds the cwebp encoder flags for the given options, without
+// the input and output paths
+func (o Options) cwebpFlags() []string {
+	return o.cwebpFlagsAt(defaultResizeWidth)
+}
+
+// cwebpFlagsAt is cwebpFlags with the output resized to width
+func (o Options) cwebpFlagsAt(width int) []string {
+	var args []string
+	if o.Z != nil {
+		args = append(args, "-z", strconv.Itoa(*o.Z))
+	} else {
+		args = append(args, "-q", strconv.Itoa(o.quality()))
+	}
+	if o.Lossless {
+		args = append(args, "-lossless")
+	}
+	if o.NearLossless != nil {
+		args = append(args, "-near_lossless", strconv.Itoa(*o.NearLossless))
+	}
+	if o.TargetSize > 0 {
+		args = append(args, "-size", strconv.Itoa(o.TargetSize))
+	}
+	if o.Hint != "" {
+		args = append(args, "-hint", o.Hint)
+	}
+	if o.JPEGLike {
+		args = append(args, "-jpeg_like")
+	}
+	if o.noAlpha() {
+		background := o.Background
+		if background == "" {
+			background = "ffffff"
+		}
+		args = append(args, "-blend_alpha", "0x"+background, "-noalpha")
+	}
+	if o.Orient == orientKeepTag {
+		args = append(args, "-metadata", "exif")
+	}
+
+	// -resize max_width 0 keeps aspect ratio, only resizes if wider than max_width
+	return append(args, "-resize", strconv.Itoa(width), "0")
+}
+
+// frame returns the animation frame to extract for static output
+func (o Options) frame() int {
+	if o.Frame != nil {
+		return *o.Frame
+	}
+	return 0
+}
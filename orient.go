@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"io"
+	"os"
+)
+
+// Orientation modes accepted by the orient query parameter
+const (
+	// orientRotatePixels applies the EXIF orientation to the pixels; the tag
+	// is dropped along with the rest of the metadata
+	orientRotatePixels = "rotate_pixels"
+	// orientKeepTag leaves the pixels untouched and copies the EXIF block,
+	// orientation included, into the WebP
+	orientKeepTag = "keep_tag"
+)
+
+// exifOrientationTag is the TIFF tag holding the EXIF orientation
+const exifOrientationTag = 0x0112
+
+// keptOrientationKey holds the EXIF orientation copied into a keep_tag
+// output, whose pixels are still in the camera's orientation
+const keptOrientationKey = "keptOrientation"
+
+// swapsAxes reports whether an EXIF orientation displays the image rotated
+// by 90 degrees, i.e. with width and height exchanged
+func swapsAxes(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG file, or 1
+// when the file isn't a JPEG or carries no orientation
+func jpegOrientation(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 1
+	}
+	defer f.Close()
+
+	return readJPEGOrientation(f)
+}
+
+// readJPEGOrientation is jpegOrientation for JPEG data read from src
+func readJPEGOrientation(src io.Reader) int {
+	r := bufio.NewReader(src)
+	var soi [2]byte
+	if _, err := io.ReadFull(r, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return 1
+	}
+
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(r, marker[:]); err != nil || marker[0] != 0xFF {
+			return 1
+		}
+		// Start of scan or end of image: the metadata segments are behind us
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			return 1
+		}
+
+		length := int(binary.BigEndian.Uint16(marker[2:])) - 2
+		if length < 0 {
+			return 1
+		}
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(r, segment); err != nil {
+			return 1
+		}
+
+		if marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+	}
+}
+
+// exifOrientation reads the orientation tag from IFD0 of a TIFF-structured
+// EXIF block
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:]))
+	if offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset:]))
+
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) != exifOrientationTag {
+			continue
+		}
+		value := int(order.Uint16(tiff[entry+8:]))
+		if value < 1 || value > 8 {
+			return 1
+		}
+		return value
+	}
+	return 1
+}
+
+// orientImage transforms an image so that it displays upright for the given
+// EXIF orientation
+func orientImage(src image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	in := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(in, in.Bounds(), src, bounds.Min, draw.Src)
+
+	// Orientations 5-8 swap the axes
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirror horizontal
+				sx, sy = w-1-x, y
+			case 3: // rotate 180
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirror vertical
+				sx, sy = x, h-1-y
+			case 5: // transpose
+				sx, sy = y, x
+			case 6: // rotate 90 clockwise
+				sx, sy = y, h-1-x
+			case 7: // transverse
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotate 90 counter-clockwise
+				sx, sy = w-1-y, x
+			}
+			copy(out.Pix[out.PixOffset(x, y):out.PixOffset(x, y)+4], in.Pix[in.PixOffset(sx, sy):in.PixOffset(sx, sy)+4])
+		}
+	}
+	return out
+}
+
+// orientFile applies a JPEG's EXIF orientation to its pixels, writing the
+// upright image as a PNG next to it. It returns inputPath unchanged when no
+// rotation is needed.
+func orientFile(inputPath string) (string, error) {
+	orientation := jpegOrientation(inputPath)
+	if orientation == 1 {
+		return inputPath, nil
+	}
+
+	img, err := decodeImage(inputPath)
+	if err != nil {
+		return "", err
+	}
+
+	outputPath := inputPath + ".orient.png"
+	if err := writePNG(outputPath, orientImage(img, orientation)); err != nil {
+		return "", err
+	}
+	return outputPath, nil
+}
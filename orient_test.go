@@ -0,0 +1,72 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestOrientImage(t *testing.T) {
+	// A 3x2 image with a marker in the top-left corner
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	marker := color.RGBA{R: 255, A: 255}
+	src.Set(0, 0, marker)
+
+	tests := []struct {
+		orientation   int
+		width, height int
+		// markerX and markerY are where the top-left pixel ends up
+		markerX, markerY int
+	}{
+		{1, 3, 2, 0, 0},
+		{2, 3, 2, 2, 0},
+		{3, 3, 2, 2, 1},
+		{4, 3, 2, 0, 1},
+		{5, 2, 3, 0, 0},
+		{6, 2, 3, 1, 0},
+		{7, 2, 3, 1, 2},
+		{8, 2, 3, 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.orientation), func(t *testing.T) {
+			out := orientImage(src, tt.orientation)
+			if got := out.Bounds(); got.Dx() != tt.width || got.Dy() != tt.height {
+				t.Fatalf("bounds = %dx%d, want %dx%d", got.Dx(), got.Dy(), tt.width, tt.height)
+			}
+			if got := color.RGBAModel.Convert(out.At(tt.markerX, tt.markerY)); got != marker {
+				t.Errorf("pixel at (%d, %d) = %v, want the marker", tt.markerX, tt.markerY, got)
+			}
+		})
+	}
+}
+
+func TestSetWebPFeatureHeadersKeptOrientation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	for orientation := 1; orientation <= 8; orientation++ {
+		t.Run(strconv.Itoa(orientation), func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(recorder)
+			c.Set(keptOrientationKey, orientation)
+			setWebPFeatureHeaders(c, webpFeatures{Width: 3, Height: 2})
+
+			wantWidth, wantHeight := "3", "2"
+			if orientation >= 5 {
+				wantWidth, wantHeight = "2", "3"
+			}
+			header := recorder.Header()
+			if got := header.Get("X-Image-Width"); got != wantWidth {
+				t.Errorf("X-Image-Width = %s, want %s", got, wantWidth)
+			}
+			if got := header.Get("X-Image-Height"); got != wantHeight {
+				t.Errorf("X-Image-Height = %s, want %s", got, wantHeight)
+			}
+			if header.Get("X-WebP-Width") != "3" || header.Get("X-WebP-Height") != "2" {
+				t.Errorf("X-WebP-Width/Height = %s/%s, want the stored 3/2", header.Get("X-WebP-Width"), header.Get("X-WebP-Height"))
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+)
+
+// Blur radius bounds accepted by the blur query parameter
+const (
+	minBlur = 0.1
+	maxBlur = 50.0
+)
+
+// decodeImage fully decodes an image file into memory
+func decodeImage(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// writePNG losslessly encodes an image for cwebp to pick up
+func writePNG(path string, img image.Image) error {
+	f, err := createPrivateFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Compression level barely matters for a throwaway intermediate file
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := encoder.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// gaussianBlur approximates a Gaussian blur with standard deviation sigma
+// using three successive box blurs, which keeps the cost independent of the
+// radius
+func gaussianBlur(src image.Image, sigma float64) *image.RGBA {
+	bounds := src.Bounds()
+	img := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(img, img.Bounds(), src, bounds.Min, draw.Src)
+
+	tmp := image.NewRGBA(img.Bounds())
+	for _, size := range boxSizes(sigma, 3) {
+		r := (size - 1) / 2
+		boxBlur(img, tmp, r, true)
+		boxBlur(tmp, img, r, false)
+	}
+	return img
+}
+
+// boxSizes returns n odd box widths whose successive application
+// approximates a Gaussian of standard deviation sigma
+func boxSizes(sigma float64, n int) []int {
+	ideal := math.Sqrt(12*sigma*sigma/float64(n) + 1)
+	lower := int(math.Floor(ideal))
+	if lower%2 == 0 {
+		lower--
+	}
+	upper := lower + 2
+
+	m := int(math.Round((12*sigma*sigma - float64(n*lower*lower+4*n*lower+3*n)) / float64(-4*lower-4)))
+
+	sizes := make([]int, n)
+	for i := range sizes {
+		if i < m {
+			sizes[i] = lower
+		} else {
+			sizes[i] = upper
+		}
+	}
+	return sizes
+}
+
+// boxBlur averages each pixel of src with its r neighbours on either side,
+// along rows when horizontal is set and along columns otherwise, writing the
+// result to dst. Edges are extended by repeating the border pixel.
+func boxBlur(src, dst *image.RGBA, r int, horizontal bool) {
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+
+	lines, length := height, width
+	lineStep, pixelStep := src.Stride, 4
+	if !horizontal {
+		lines, length = width, height
+		lineStep, pixelStep = 4, src.Stride
+	}
+
+	window := 2*r + 1
+	for line := 0; line < lines; line++ {
+		base := line * lineStep
+		at := func(i int) int {
+			if i < 0 {
+				i = 0
+			} else if i >= length {
+				i = length - 1
+			}
+			return base + i*pixelStep
+		}
+
+		for ch := 0; ch < 4; ch++ {
+			sum := 0
+			for i := -r; i <= r; i++ {
+				sum += int(src.Pix[at(i)+ch])
+			}
+			for i := 0; i < length; i++ {
+				dst.Pix[base+i*pixelStep+ch] = uint8(sum / window)
+				sum += int(src.Pix[at(i+r+1)+ch]) - int(src.Pix[at(i-r)+ch])
+			}
+		}
+	}
+}
+
+// blurFile decodes inputPath, blurs it and writes the result as a PNG next
+// to it, returning the new path
+func blurFile(inputPath string, sigma float64) (string, error) {
+	img, err := decodeImage(inputPath)
+	if err != nil {
+		return "", err
+	}
+
+	outputPath := inputPath + ".blur.png"
+	if err := writePNG(outputPath, gaussianBlur(img, sigma)); err != nil {
+		return "", err
+	}
+	return outputPath, nil
+}
+
+// isCMYKJPEG reports whether a file is a four-component (CMYK or YCCK)
+// JPEG, which cwebp converts with inverted or shifted colors
+func isCMYKJPEG(path string) bool {
+	config, format, err := readImageConfig(path)
+	return err == nil && format == "jpeg" && config.ColorModel == color.CMYKModel
+}
+
+// cmykToRGBFile decodes a CMYK JPEG, which Go's decoder does correctly
+// including Adobe's inverted variant, and writes it as an RGB PNG next to
+// it, returning the new path
+func cmykToRGBFile(inputPath string) (string, error) {
+	img, err := decodeImage(inputPath)
+	if err != nil {
+		return "", err
+	}
+
+	outputPath := inputPath + ".rgb.png"
+	if err := writePNG(outputPath, img); err != nil {
+		return "", err
+	}
+	return outputPath, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// Placeholder settings: a tiny, heavily compressed, slightly blurred image
+// meant to be stretched by the browser while the full image loads
+const (
+	previewWidth   = 20
+	previewBlur    = 1.0
+	previewQuality = 30
+)
+
+// The X-Placeholder header variant is smaller still, and dropped rather
+// than risk pushing the response past a proxy's header size limit
+const (
+	placeholderHeaderWidth    = 16
+	maxPlaceholderHeaderBytes = 2048
+)
+
+// generatePreview builds a blur-up placeholder from an encoded WebP by
+// decoding it, downscaling to width, blurring and re-encoding
+func generatePreview(ctx context.Context, webpData []byte, tempDir string, width int) ([]byte, error) {
+	img, err := webp.Decode(bytes.NewReader(webpData))
+	if err != nil {
+		return nil, err
+	}
+
+	pngPath := filepath.Join(tempDir, "preview.png")
+	if err := writePNG(pngPath, gaussianBlur(scaleToWidth(img, width), previewBlur)); err != nil {
+		return nil, err
+	}
+
+	outputPath := filepath.Join(tempDir, "preview.webp")
+	if _, err := runCwebp(ctx, []string{"-q", strconv.Itoa(previewQuality)}, pngPath, outputPath); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(outputPath)
+}
+
+// scaleToWidth resizes an image to the given width, keeping its aspect ratio
+func scaleToWidth(src image.Image, width int) image.Image {
+	bounds := src.Bounds()
+	if bounds.Dx() <= width {
+		return src
+	}
+
+	height := max(1, bounds.Dy()*width/bounds.Dx())
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, xdraw.Src, nil)
+	return dst
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// vp8xFlagXMP is the VP8X feature flag announcing an XMP chunk
+const vp8xFlagXMP = 0x04
+
+// provenanceXMP is a minimal XMP packet naming this service as the creator
+// tool and recording the encoder settings. It is kept to a few hundred
+// bytes, with no padding or xpacket wrapper, so small outputs barely grow.
+const provenanceXMP = `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` +
+	`<rdf:Description rdf:about="" xmlns:xmp="http://ns.adobe.com/xap/1.0/" xmlns:webp="urn:image-compress-go-webp:1"` +
+	` xmp:CreatorTool="%s" webp:Compression="%s" webp:Quality="%d"/></rdf:RDF></x:xmpmeta>`
+
+// addProvenance returns the WebP with an XMP chunk recording that this
+// service produced it and at what quality, converting a simple (VP8/VP8L)
+// file to the extended format the chunk requires
+func addProvenance(data []byte, quality int) ([]byte, error) {
+	features, err := parseWebPFeatures(data)
+	if err != nil {
+		return nil, err
+	}
+	xmp := fmt.Sprintf(provenanceXMP, cfg.ServiceName, compressionOf(data), quality)
+
+	chunks := data[12:]
+	var out []byte
+	out = append(out, "RIFF\x00\x00\x00\x00WEBP"...)
+	if string(chunks[0:4]) == "VP8X" {
+		chunks = append([]byte(nil), chunks...)
+		chunks[8] |= vp8xFlagXMP
+	} else {
+		// A simple file's only alpha is inside a VP8L bitstream, so
+		// the alpha flag is left clear: x/image/webp rejects it on VP8L
+		// images, and libwebp reads alpha from the bitstream anyway
+		vp8x := make([]byte, 10)
+		vp8x[0] = vp8xFlagXMP
+		putUint24(vp8x[4:], features.Width-1)
+		putUint24(vp8x[7:], features.Height-1)
+		out = appendChunk(out, "VP8X", vp8x)
+	}
+	out = append(out, chunks...)
+	out = appendChunk(out, "XMP ", []byte(xmp))
+
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+// appendChunk appends a RIFF chunk, padded to an even size
+func appendChunk(out []byte, fourCC string, payload []byte) []byte {
+	out = append(out, fourCC...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(payload)))
+	out = append(out, payload...)
+	if len(payload)%2 == 1 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+// putUint24 writes a little-endian 24 bit value
+func putUint24(b []byte, v int) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// qualityTier is the default quality for images whose longest side is
+// under maxSide pixels; 0 matches any size
+type qualityTier struct {
+	maxSide int
+	quality int
+}
+
+// qualityTiers parses QUALITY_TIERS, e.g. "100:90,1000:82,75": items of
+// maxSide:quality and at most one bare quality for everything larger. The
+// tiers are returned smallest first with the catch-all last.
+func qualityTiers() []qualityTier {
+	var tiers []qualityTier
+	for _, item := range envList("QUALITY_TIERS") {
+		tier, ok := parseQualityTier(item)
+		if !ok {
+			log.Printf("Ignoring invalid QUALITY_TIERS item %q", item)
+			continue
+		}
+		tiers = append(tiers, tier)
+	}
+	slices.SortStableFunc(tiers, func(a, b qualityTier) int {
+		switch {
+		case a.maxSide == b.maxSide:
+			return 0
+		case a.maxSide == 0:
+			return 1
+		case b.maxSide == 0:
+			return -1
+		}
+		return a.maxSide - b.maxSide
+	})
+	return tiers
+}
+
+func parseQualityTier(item string) (qualityTier, bool) {
+	side, quality, hasSide := strings.Cut(item, ":")
+	if !hasSide {
+		side, quality = "0", item
+	}
+	maxSide, err := strconv.Atoi(strings.TrimSpace(side))
+	if err != nil || maxSide < 0 || (hasSide && maxSide == 0) {
+		return qualityTier{}, false
+	}
+	q, err := strconv.Atoi(strings.TrimSpace(quality))
+	if err != nil || q < 0 || q > 100 {
+		return qualityTier{}, false
+	}
+	return qualityTier{maxSide: maxSide, quality: q}, true
+}
+
+// tierQuality returns the QUALITY_TIERS quality for an image of the given
+// size, if any tier matches
+func tierQuality(width, height int) (int, bool) {
+	side := max(width, height)
+	for _, tier := range cfg.QualityTiers {
+		if tier.maxSide == 0 || side < tier.maxSide {
+			return tier.quality, true
+		}
+	}
+	return 0, false
+}
+
+// applyQualityTier sets the quality from QUALITY_TIERS for an image of the
+// given decoded size, when the request leaves the lossy quality to the
+// server. Options that pick a quality themselves are left alone.
+func applyQualityTier(opts *Options, width, height int) {
+	if opts.Quality != nil || opts.Lossless || opts.NearLossless != nil || opts.Z != nil ||
+		opts.TargetSize > 0 || opts.SSIM != 0 || opts.Mode != "" {
+		return
+	}
+	q, ok := tierQuality(width, height)
+	if !ok {
+		return
+	}
+	q = constrainQuality(q)
+	opts.Quality = &q
+}
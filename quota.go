@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// conversionQuota counts conversions per API key over a sliding window
+type conversionQuota struct {
+	limit  int
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[string][]time.Time // oldest first
+}
+
+func newConversionQuota(limit int, window time.Duration) *conversionQuota {
+	return &conversionQuota{
+		limit:  limit,
+		window: window,
+		seen:   make(map[string][]time.Time),
+	}
+}
+
+// take records a conversion for key if it is within quota. It returns the
+// conversions left in the window and when the oldest one expires.
+func (q *conversionQuota) take(key string, now time.Time) (ok bool, remaining int, reset time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	times := q.seen[key]
+	cutoff := now.Add(-q.window)
+	expired := 0
+	for expired < len(times) && !times[expired].After(cutoff) {
+		expired++
+	}
+	times = times[expired:]
+
+	if len(times) >= q.limit {
+		q.seen[key] = times
+		return false, 0, times[0].Add(q.window)
+	}
+
+	times = append(times, now)
+	q.seen[key] = times
+	return true, q.limit - len(times), times[0].Add(q.window)
+}
+
+// refund gives back a conversion taken at taken, for a request that failed
+func (q *conversionQuota) refund(key string, taken time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	times := q.seen[key]
+	for i := len(times) - 1; i >= 0; i-- {
+		if times[i].Equal(taken) {
+			q.seen[key] = append(times[:i], times[i+1:]...)
+			return
+		}
+	}
+}
+
+// quotaMiddleware rejects requests from API keys that have used up their
+// conversions for the current window. Requests without an authenticated key
+// are not metered, and requests that fail (invalid options, oversized or
+// unsupported input, a busy server) are refunded once the handler returns.
+func quotaMiddleware(q *conversionQuota) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetString(apiKeyContextKey)
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		now := time.Now()
+		ok, remaining, reset := q.take(key, now)
+		c.Header("X-Quota-Limit", strconv.Itoa(q.limit))
+		c.Header("X-Quota-Remaining", strconv.Itoa(remaining))
+		c.Header("X-Quota-Reset", strconv.FormatInt(reset.Unix(), 10))
+
+		if !ok {
+			c.Header("Retry-After", strconv.Itoa(int(time.Until(reset).Seconds())+1))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error": "Conversion quota exceeded",
+				"reset": reset.UTC().Format(time.RFC3339),
+			})
+			return
+		}
+
+		c.Next()
+		if responseStatus(c) >= http.StatusBadRequest {
+			q.refund(key, now)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Bounds on the widths parameter
+const (
+	maxResponsiveWidths = 10
+	maxResponsiveWidth  = 10000
+)
+
+// responsiveImage is one encoded width of a responsive set
+type responsiveImage struct {
+	filename string
+	width    int
+	data     []byte
+}
+
+// responsiveFilename names the image for one width, e.g. photo-320w.webp
+func responsiveFilename(outputFilename string, width int) string {
+	return fmt.Sprintf("%s-%dw.webp", strings.TrimSuffix(outputFilename, ".webp"), width)
+}
+
+// encodeResponsiveSet runs cwebp once per requested width. The prepared
+// input is decoded once and scaled down in-process for each width, so
+// cwebp only reads a small PNG instead of decoding the full source every
+// time. Inputs Go can't decode, and keep_tag requests whose EXIF a PNG
+// would drop, go to cwebp as they are. On failure it returns the encoder
+// output for the error response.
+func encodeResponsiveSet(c *gin.Context, opts Options, source *sourceImage, tempDir, outputFilename string) ([]responsiveImage, []byte, error) {
+	inputPath := source.path
+	defer source.release()
+	img, err := source.decode()
+	prescale := err == nil && opts.Orient != orientKeepTag
+
+	images := make([]responsiveImage, 0, len(opts.Widths))
+	for _, width := range opts.Widths {
+		filename := responsiveFilename(outputFilename, width)
+		outputPath := filepath.Join(tempDir, filename)
+		widthInput := inputPath
+		if prescale {
+			widthInput = fmt.Sprintf("%s.%dw.png", inputPath, width)
+			if err := writePNG(widthInput, scaleToWidth(img, width)); err != nil {
+				return nil, nil, err
+			}
+		}
+		if output, err := runCwebp(c.Request.Context(), opts.cwebpFlagsAt(width), widthInput, outputPath); err != nil {
+			return nil, output, err
+		}
+		data, err := os.ReadFile(outputPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		if opts.provenance() {
+			if data, err = addProvenance(data, opts.quality()); err != nil {
+				return nil, nil, err
+			}
+		}
+		images = append(images, responsiveImage{filename: filename, width: width, data: data})
+	}
+	return images, nil, nil
+}
+
+// respondResponsiveSet sends a responsive set as a ZIP archive, or as a JSON
+// manifest with base64 data when the client wants JSON
+func respondResponsiveSet(c *gin.Context, outputFilename string, images []responsiveImage) {
+	if wantsJSON(c) {
+		results := make([]conversionResult, len(images))
+		for i, img := range images {
+			results[i] = conversionResult{
+				Filename:    img.filename,
+				Width:       img.width,
+				ContentType: "image/webp",
+				Size:        len(img.data),
+				Data:        base64.StdEncoding.EncodeToString(img.data),
+			}
+			if features, err := parseWebPFeatures(img.data); err == nil {
+				results[i].Features = &features
+			}
+		}
+		c.JSON(http.StatusOK, gin.H{"images": results})
+		return
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, img := range images {
+		// WebP is already compressed, so store the entries as-is; the
+		// gzip middleware compresses the archive as a whole when asked
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: img.filename, Method: zip.Store, Modified: time.Now()})
+		if err == nil {
+			_, err = w.Write(img.data)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build ZIP archive"})
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build ZIP archive"})
+		return
+	}
+
+	zipName := strings.TrimSuffix(outputFilename, ".webp") + ".zip"
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", zipName))
+	c.Data(http.StatusOK, "application/zip", buf.Bytes())
+}
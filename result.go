@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// conversionResult is the body of a JSON-mode response
+type conversionResult struct {
+	Filename    string        `json:"filename"`
+	ContentType string        `json:"contentType"`
+	Size        int           `json:"size"`
+	Features    *webpFeatures `json:"features,omitempty"`
+	// Data is the base64-encoded image
+	Data string `json:"data"`
+	// Preview is a base64-encoded blur-up placeholder, when requested
+	Preview string `json:"preview,omitempty"`
+	// Width is the requested width of an image in a responsive set
+	Width int `json:"width,omitempty"`
+}
+
+// wantsJSON reports whether the client asked for a JSON response carrying
+// the image as base64 instead of the raw bytes. JSON requests always get
+// JSON back.
+func wantsJSON(c *gin.Context) bool {
+	if c.Query("response") == "json" || isJSONRequest(c) {
+		return true
+	}
+	accept := c.GetHeader("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "image/")
+}
+
+// respondJSON sends the converted image base64-encoded in a JSON body,
+// adding a placeholder preview when with_preview=true
+func respondJSON(c *gin.Context, filename string, data []byte, tempDir string) {
+	result := conversionResult{
+		Filename:    filename,
+		ContentType: "image/webp",
+		Size:        len(data),
+		Data:        base64.StdEncoding.EncodeToString(data),
+	}
+	if features, err := parseWebPFeatures(data); err == nil {
+		result.Features = &features
+	}
+
+	if c.Query("with_preview") == "true" {
+		preview, err := generatePreview(c.Request.Context(), data, tempDir, previewWidth)
+		if err != nil {
+			// The full image is still usable without its placeholder
+			log.Printf("Failed to generate preview: %v", err)
+		} else {
+			result.Preview = base64.StdEncoding.EncodeToString(preview)
+		}
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// exceedsOutputLimit responds 422 with the actual size when an output is
+// over the request's max_output_bytes budget
+func exceedsOutputLimit(c *gin.Context, opts Options, size int) bool {
+	if opts.MaxOutputBytes == 0 || size <= opts.MaxOutputBytes {
+		return false
+	}
+	c.JSON(http.StatusUnprocessableEntity, gin.H{
+		"error":    "Converted image exceeds max_output_bytes",
+		"size":     size,
+		"maxBytes": opts.MaxOutputBytes,
+	})
+	return true
+}
+
+// sendWebP responds with a converted image: base64 in JSON when the client
+// asked for that, the raw file with its features in headers otherwise
+func sendWebP(c *gin.Context, filename string, data []byte, tempDir string) {
+	if wantsJSON(c) {
+		respondJSON(c, filename, data, tempDir)
+		return
+	}
+
+	if features, err := parseWebPFeatures(data); err == nil {
+		setWebPFeatureHeaders(c, features)
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	c.Header("X-WebP-Size", strconv.Itoa(len(data)))
+	setPlaceholderHeader(c, data, tempDir)
+
+	// HEAD gets the headers of the full response without the body
+	if c.Request.Method == http.MethodHead {
+		c.Header("Content-Type", "image/webp")
+		c.Header("Content-Length", strconv.Itoa(len(data)))
+		c.Status(http.StatusOK)
+		return
+	}
+	c.Header("Trailer", "X-Conversion-Warnings, X-Conversion-Stats-JSON")
+	c.Data(http.StatusOK, "image/webp", data)
+	setConversionTrailers(c, data)
+}
+
+// setPlaceholderHeader adds a tiny blurred WebP, base64-encoded, as
+// X-Placeholder when placeholder_header=true, so binary responses can carry
+// a blur-up placeholder too
+func setPlaceholderHeader(c *gin.Context, data []byte, tempDir string) {
+	if c.Query("placeholder_header") != "true" {
+		return
+	}
+	placeholder, err := generatePreview(c.Request.Context(), data, tempDir, placeholderHeaderWidth)
+	if err != nil {
+		log.Printf("Failed to generate placeholder: %v", err)
+		return
+	}
+	encoded := base64.StdEncoding.EncodeToString(placeholder)
+	if len(encoded) > maxPlaceholderHeaderBytes {
+		log.Printf("Dropping %d byte placeholder header", len(encoded))
+		return
+	}
+	c.Header("X-Placeholder", encoded)
+}
+
+// responseETag is the validator of a response built from the cache entry
+// key. The key identifies the input and every option, so it's a strong
+// validator for the WebP bytes; the response mode and anything added next
+// to the image (JSON wrapping, previews, placeholder header) are mixed in
+// so that each representation gets its own ETag.
+func responseETag(c *gin.Context, key string) string {
+	h := sha256.New()
+	h.Write([]byte(key))
+	fmt.Fprintf(h, "json=%t preview=%t placeholder=%t",
+		wantsJSON(c), c.Query("with_preview") == "true", c.Query("placeholder_header") == "true")
+	return `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+}
+
+// conversionStartKey holds when convertToWebP started, and inputBytesKey
+// the upload size, for the stats trailer
+const (
+	conversionStartKey = "conversionStart"
+	inputBytesKey      = "inputBytes"
+)
+
+// conversionStats is the X-Conversion-Stats-JSON trailer
+type conversionStats struct {
+	InputBytes  int64   `json:"inputBytes"`
+	OutputBytes int     `json:"outputBytes"`
+	SavedRatio  float64 `json:"savedRatio"`
+	DurationMs  int64   `json:"durationMs"`
+	Width       int     `json:"width,omitempty"`
+	Height      int     `json:"height,omitempty"`
+}
+
+// setConversionTrailers fills in the trailers declared by sendWebP once the
+// body is written: the response's Warning values and a JSON summary of the
+// conversion. Clients that ignore trailers still have the plain headers.
+func setConversionTrailers(c *gin.Context, data []byte) {
+	header := c.Writer.Header()
+	if warnings := header.Values("Warning"); len(warnings) > 0 {
+		header.Set("X-Conversion-Warnings", strings.Join(warnings, ", "))
+	}
+
+	stats := conversionStats{
+		InputBytes:  c.GetInt64(inputBytesKey),
+		OutputBytes: len(data),
+		DurationMs:  time.Since(c.GetTime(conversionStartKey)).Milliseconds(),
+	}
+	if stats.InputBytes > 0 {
+		stats.SavedRatio = 1 - float64(len(data))/float64(stats.InputBytes)
+	}
+	if features, err := parseWebPFeatures(data); err == nil {
+		stats.Width, stats.Height = features.Width, features.Height
+	}
+	if encoded, err := json.Marshal(stats); err == nil {
+		header.Set("X-Conversion-Stats-JSON", string(encoded))
+	}
+}
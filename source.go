@@ -0,0 +1,34 @@
+package main
+
+import "image"
+
+// sourceImage is a request's prepared encoder input, decoded at most once.
+// convertToWebP creates it and hands the same one to every mode that needs
+// the pixels: responsive sets, AVIF in /optimize and auto_format, and
+// /compare-quality.
+type sourceImage struct {
+	path    string
+	img     image.Image
+	err     error
+	decoded bool
+}
+
+func newSourceImage(path string) *sourceImage {
+	return &sourceImage{path: path}
+}
+
+// decode returns the decoded image, decoding the file on first use
+func (s *sourceImage) decode() (image.Image, error) {
+	if !s.decoded {
+		s.img, s.err = decodeImage(s.path)
+		s.decoded = true
+	}
+	return s.img, s.err
+}
+
+// release drops the decoded pixels as soon as the outputs are encoded,
+// rather than holding them while the response is written
+func (s *sourceImage) release() {
+	s.img = nil
+	s.decoded = false
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// progressContextKey holds the func that reports pipeline stages of a
+// /convert/stream request
+const progressContextKey = "progress"
+
+// conversionStatusKey holds the status a /convert/stream conversion ended
+// with, which the event stream's own 200 hides from the middleware
+const conversionStatusKey = "conversionStatus"
+
+// responseStatus is the status a request's outcome counts as for quotas,
+// metrics, logs and traces: the streamed conversion's when there was one,
+// otherwise the status written
+func responseStatus(c *gin.Context) int {
+	if status := c.GetInt(conversionStatusKey); status != 0 {
+		return status
+	}
+	return c.Writer.Status()
+}
+
+// reportStage tells a /convert/stream client that the conversion reached
+// stage. Other requests ignore it.
+func reportStage(c *gin.Context, stage string) {
+	if value, exists := c.Get(progressContextKey); exists {
+		report := value.(func(string))
+		report(stage)
+	}
+}
+
+// capturedResponse buffers what convertToWebP writes so it can be stored
+// as a result instead of being sent down the event stream
+type capturedResponse struct {
+	gin.ResponseWriter
+	header http.Header
+	status int
+	body   []byte
+}
+
+func (w *capturedResponse) Header() http.Header { return w.header }
+
+func (w *capturedResponse) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *capturedResponse) WriteHeaderNow() {
+	w.WriteHeader(http.StatusOK)
+}
+
+func (w *capturedResponse) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	w.body = append(w.body, data...)
+	return len(data), nil
+}
+
+func (w *capturedResponse) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *capturedResponse) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *capturedResponse) Size() int { return len(w.body) }
+
+func (w *capturedResponse) Written() bool { return w.status != 0 }
+
+func (w *capturedResponse) Flush() {}
+
+// storedResult is a finished /convert/stream conversion waiting to be
+// downloaded
+type storedResult struct {
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"contentType"`
+	Size        int       `json:"size"`
+	URL         string    `json:"url"`
+	Expires     time.Time `json:"expires"`
+}
+
+// resultStore keeps converted images on disk for ResultTTL so that event
+// stream clients can fetch them with a plain GET
+type resultStore struct {
+	dir string
+	ttl time.Duration
+
+	mu      sync.Mutex
+	results map[string]storedResult
+}
+
+// results holds /convert/stream outputs
+var results *resultStore
+
+// newResultStore creates the result directory, discarding results left by
+// a previous run since their metadata was only kept in memory
+func newResultStore(dir string, ttl time.Duration) (*resultStore, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, privateDirPerm); err != nil {
+		return nil, err
+	}
+	return &resultStore{dir: dir, ttl: ttl, results: make(map[string]storedResult)}, nil
+}
+
+// save stores data under a new ID and schedules its removal
+func (s *resultStore) save(data []byte, filename, contentType string) (string, storedResult, error) {
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", storedResult{}, err
+	}
+	id := hex.EncodeToString(raw[:])
+	if err := os.WriteFile(filepath.Join(s.dir, id), data, privateFilePerm); err != nil {
+		return "", storedResult{}, err
+	}
+
+	result := storedResult{
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        len(data),
+		URL:         "/convert/results/" + id,
+		Expires:     time.Now().Add(s.ttl).UTC(),
+	}
+	s.mu.Lock()
+	s.results[id] = result
+	s.mu.Unlock()
+	time.AfterFunc(s.ttl, func() { s.remove(id) })
+	return id, result, nil
+}
+
+// get returns a live result
+func (s *resultStore) get(id string) (storedResult, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result, ok := s.results[id]
+	return result, ok && time.Now().Before(result.Expires)
+}
+
+func (s *resultStore) remove(id string) {
+	s.mu.Lock()
+	delete(s.results, id)
+	s.mu.Unlock()
+	if err := os.Remove(filepath.Join(s.dir, id)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to remove expired result %s: %v", id, err)
+	}
+}
+
+// convertStream runs a normal conversion while reporting its stages as
+// Server-Sent Events: received, validating, converting, then either done
+// with a link to the stored result or error with the failure's body
+func convertStream(c *gin.Context) {
+	if results == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Result storage is unavailable"})
+		return
+	}
+
+	stream := c.Writer
+	stream.Header().Set("Content-Type", "text/event-stream")
+	stream.Header().Set("Cache-Control", "no-cache")
+	stream.Header().Set("X-Accel-Buffering", "no")
+	stream.WriteHeader(http.StatusOK)
+	send := func(event string, data any) {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(stream, "event: %s\ndata: %s\n\n", event, encoded)
+		stream.Flush()
+	}
+
+	captured := &capturedResponse{ResponseWriter: stream, header: make(http.Header)}
+	c.Writer = captured
+	c.Set(progressContextKey, func(stage string) {
+		send("stage", gin.H{"stage": stage})
+	})
+	convertToWebP(c)
+	c.Writer = stream
+	c.Set(conversionStatusKey, captured.Status())
+
+	if captured.Status() >= http.StatusBadRequest {
+		body := json.RawMessage(captured.body)
+		if !json.Valid(body) {
+			body, _ = json.Marshal(gin.H{"error": string(captured.body)})
+		}
+		send("error", gin.H{"status": captured.Status(), "body": body})
+		return
+	}
+
+	filename := "image.webp"
+	if _, params, err := mime.ParseMediaType(captured.header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		filename = params["filename"]
+	}
+	contentType := captured.header.Get("Content-Type")
+	_, result, err := results.save(captured.body, filename, contentType)
+	if err != nil {
+		log.Printf("Failed to store result: %v", err)
+		c.Set(conversionStatusKey, http.StatusInternalServerError)
+		send("error", gin.H{"status": http.StatusInternalServerError, "body": gin.H{"error": "Failed to store converted file"}})
+		return
+	}
+	send("stage", gin.H{"stage": "done"})
+	send("done", result)
+}
+
+// downloadResult serves a stored /convert/stream result
+func downloadResult(c *gin.Context) {
+	id := c.Param("id")
+	if results == nil || !isUploadID(id) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Result not found or expired"})
+		return
+	}
+	result, ok := results.get(id)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Result not found or expired"})
+		return
+	}
+	data, err := os.ReadFile(filepath.Join(results.dir, id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Result not found or expired"})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", result.Filename))
+	c.Header("Content-Length", strconv.Itoa(len(data)))
+	c.Data(http.StatusOK, result.ContentType, data)
+}
+
+// isReportingProgress reports whether c is a /convert/stream request
+func isReportingProgress(c *gin.Context) bool {
+	_, exists := c.Get(progressContextKey)
+	return exists
+}
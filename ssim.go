@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+// ssimMaxIterations bounds the quality search; seven halvings cover 0..100
+const ssimMaxIterations = 7
+
+// ssimTotalPattern matches the overall figure cwebp -print_ssim reports, in
+// dB, e.g. "Total:17.52"
+var ssimTotalPattern = regexp.MustCompile(`Total:\s*([0-9.]+)`)
+
+var errNoSSIM = errors.New("cwebp didn't report SSIM")
+
+// parseSSIM extracts the SSIM cwebp printed and converts it from dB back to
+// the 0..1 scale
+func parseSSIM(output []byte) (float64, error) {
+	match := ssimTotalPattern.FindSubmatch(output)
+	if match == nil {
+		return 0, errNoSSIM
+	}
+	dB, err := strconv.ParseFloat(string(match[1]), 64)
+	if err != nil {
+		return 0, err
+	}
+	return 1 - math.Pow(10, -dB/10), nil
+}
+
+// ssimQualities are the qualities the search may pick from: ALLOWED_QUALITIES
+// when set, otherwise every quality, in both cases from MIN_QUALITY up
+func ssimQualities() []int {
+	var qualities []int
+	if len(cfg.AllowedQualities) > 0 {
+		qualities = slices.Clone(cfg.AllowedQualities)
+		slices.Sort(qualities)
+	} else {
+		for q := 0; q <= 100; q++ {
+			qualities = append(qualities, q)
+		}
+	}
+	return slices.DeleteFunc(qualities, func(q int) bool { return q < cfg.MinQuality })
+}
+
+// encodeForSSIM binary-searches for the lowest quality whose output reaches
+// the target SSIM, leaving that output at outputPath and returning its
+// quality. When no quality reaches the target, the highest is used.
+func encodeForSSIM(ctx context.Context, opts Options, inputPath, outputPath string) (int, []byte, error) {
+	qualities := ssimQualities()
+	if len(qualities) == 0 {
+		return 0, nil, errors.New("no quality is allowed")
+	}
+
+	trialPath := outputPath + ".trial"
+	best := -1
+	lo, hi := 0, len(qualities)-1
+	for i := 0; i < ssimMaxIterations && lo <= hi; i++ {
+		mid := (lo + hi) / 2
+		trial := opts
+		trial.Quality = &qualities[mid]
+
+		output, err := runCwebp(ctx, append(trial.cwebpFlags(), "-print_ssim"), inputPath, trialPath)
+		if err != nil {
+			return 0, output, err
+		}
+		ssim, err := parseSSIM(output)
+		if err != nil {
+			return 0, output, err
+		}
+
+		if ssim >= opts.SSIM {
+			best = mid
+			if err := os.Rename(trialPath, outputPath); err != nil {
+				return 0, nil, err
+			}
+			hi = mid - 1
+		} else {
+			lo = mid + 1
+		}
+	}
+	if best >= 0 {
+		return qualities[best], nil, nil
+	}
+
+	// Even the highest quality falls short, or the search ran out of
+	// iterations before finding one: settle for the highest
+	top := opts
+	top.Quality = &qualities[len(qualities)-1]
+	output, err := runCwebp(ctx, top.cwebpFlags(), inputPath, outputPath)
+	return *top.Quality, output, err
+}
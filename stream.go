@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"image"
+	"image/color"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// streamSniffLen is how much of a streamed upload is buffered to identify
+// its format, dimensions and orientation before the rest is piped to cwebp
+const streamSniffLen = 64 << 10
+
+// streamingFormats are the inputs cwebp reads directly without any
+// preprocessing
+var streamingFormats = map[string]bool{
+	"jpeg": true,
+	"png":  true,
+	"tiff": true,
+	"webp": true,
+}
+
+// openStreamedUpload finds the "image" part of a multipart body without
+// buffering the form, returning it with an unknown (-1) size
+func openStreamedUpload(c *gin.Context) (*upload, *httpError) {
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, &httpError{http.StatusBadRequest, gin.H{"error": "No image file provided"}}
+	}
+	for {
+		part, err := reader.NextPart()
+		if isBodyTooLarge(err) {
+			return nil, uploadTooLarge()
+		}
+		if err != nil {
+			return nil, &httpError{http.StatusBadRequest, gin.H{"error": "No image file provided"}}
+		}
+		if part.FormName() == "image" && part.FileName() != "" {
+			return &upload{Reader: part, name: part.FileName(), size: -1, close: part.Close}, nil
+		}
+		part.Close()
+	}
+}
+
+// canStream reports whether a request leaves nothing to do but run cwebp,
+// so that a streamed upload can be piped straight into it. The cache needs
+// the content hash before encoding, as does the denylist, so those requests
+// are saved to disk. Progress-reporting requests are too, so that every
+// stage is reported.
+func canStream(c *gin.Context, opts Options, useCache bool) bool {
+	return !useCache && len(cfg.Denylist) == 0 && opts.Blur == 0 && len(opts.Widths) == 0 && opts.SSIM == 0 && opts.Mode == "" &&
+		!c.GetBool(optimizeContextKey) && !c.GetBool(compareContextKey) && !isReportingProgress(c) && c.Query("auto_format") != "true" && c.Query("verify") != "true"
+}
+
+// countingReader counts the bytes read through it and keeps the first read
+// error, which exec's stdin copy would otherwise swallow
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// streamUpload pipes a streamed upload into cwebp's stdin when its header
+// shows a format cwebp reads as-is, and answers the request. It returns
+// false without consuming anything past the sniffed header when the upload
+// needs the temp-file path instead.
+func streamUpload(c *gin.Context, file *upload, sniffed *bufio.Reader, opts Options, tempDir string) bool {
+	head, _ := sniffed.Peek(streamSniffLen)
+	imgConfig, format, err := image.DecodeConfig(bytes.NewReader(head))
+	if err != nil || !streamingFormats[format] {
+		return false
+	}
+	// CMYK JPEGs need the buffered CMYK to sRGB conversion
+	if imgConfig.ColorModel == color.CMYKModel {
+		return false
+	}
+	if features, err := parseWebPFeatures(head); format == "webp" && (err != nil || features.Animated) {
+		return false
+	}
+	if format == "jpeg" && opts.Orient == orientRotatePixels && readJPEGOrientation(bytes.NewReader(head)) != 1 {
+		return false
+	}
+	if format == "jpeg" && opts.Orient == orientKeepTag {
+		c.Set(keptOrientationKey, readJPEGOrientation(bytes.NewReader(head)))
+	}
+
+	start := time.Now()
+	counter := &countingReader{r: sniffed}
+	outputSize := 0
+	defer func() {
+		success := c.Writer.Status() < http.StatusBadRequest
+		metrics.observe(format, success, counter.n, int64(outputSize), time.Since(start))
+	}()
+
+	if exceedsMaxPixels(imgConfig.Width, imgConfig.Height) {
+		rejectOversized(c, imgConfig.Width, imgConfig.Height)
+		return true
+	}
+	applyQualityTier(&opts, imgConfig.Width, imgConfig.Height)
+
+	// One byte over the limit is enough to know it was exceeded
+	var input io.Reader = counter
+	limit := uploadLimit(format)
+	if limit > 0 {
+		input = io.LimitReader(counter, limit+1)
+	}
+
+	flags := opts.cwebpFlags()
+	if cfg.Debug {
+		c.Header("X-Cwebp-Args", strings.Join(flags, " "))
+	}
+	ctx, span := tracer.Start(c.Request.Context(), "cwebp.exec", trace.WithAttributes(
+		attribute.String("encoder", "cwebp"),
+		attribute.Bool("upload.streamed", true),
+		attribute.String("cwebp.args", strings.Join(flags, " ")),
+	))
+	defer func() { span.End() }()
+
+	hasher := sha256.New()
+	outputPath := filepath.Join(tempDir, "streamed.webp")
+	output, err := runCwebpStdin(ctx, flags, io.TeeReader(input, hasher), outputPath)
+	switch {
+	case isBodyTooLarge(counter.err):
+		uploadTooLarge().respond(c)
+		return true
+	case limit > 0 && counter.n > limit:
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error":    "Upload exceeds the maximum allowed size for this format",
+			"format":   format,
+			"maxBytes": limit,
+		})
+		return true
+	case respondDiskFull(c, err):
+		return true
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error":   "Failed to convert image",
+			"details": cwebpErrorDetails(output),
+		})
+		return true
+	}
+
+	recordConversion()
+	c.Set(inputBytesKey, counter.n)
+
+	webpData, err := os.ReadFile(outputPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read converted file"})
+		return true
+	}
+	if opts.provenance() {
+		if webpData, err = addProvenance(webpData, opts.quality()); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add provenance metadata"})
+			return true
+		}
+	}
+	outputSize = len(webpData)
+	if exceedsOutputLimit(c, opts, len(webpData)) {
+		return true
+	}
+	span.SetAttributes(attribute.Int64("upload.size", counter.n), attribute.Int("webp.size", len(webpData)))
+	span.End()
+
+	_, span = tracer.Start(c.Request.Context(), "response.write")
+	sendWebP(c, renderFilename(cfg.FilenameTemplate, file.name, hasher.Sum(nil), time.Now()), webpData, tempDir)
+	return true
+}
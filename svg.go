@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// svgSniffLen is how much of a file is inspected when looking for an <svg
+// root element
+const svgSniffLen = 4096
+
+// defaultSVGWidth is the rasterization width used when the request sets
+// neither width nor height
+const defaultSVGWidth = 1200
+
+// maxSVGDimension bounds the rasterization width and height, whether
+// requested or derived from the SVG's aspect ratio
+const maxSVGDimension = 10000
+
+// svgRasterizer is the SVG-to-PNG tool found at startup ("rsvg-convert" or
+// "resvg"), empty when SVG input is unsupported
+var svgRasterizer string
+
+// detectSVGRasterizer looks for a supported SVG rasterizer on PATH
+func detectSVGRasterizer() {
+	for _, tool := range []string{"rsvg-convert", "resvg"} {
+		if _, err := exec.LookPath(tool); err == nil {
+			svgRasterizer = tool
+			log.Printf("SVG input enabled via %s", tool)
+			return
+		}
+	}
+	log.Printf("SVG input disabled: neither rsvg-convert nor resvg found")
+}
+
+// isSVG reports whether a file looks like an SVG document, i.e. an XML
+// document whose root element is <svg
+func isSVG(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, svgSniffLen)
+	n, _ := io.ReadFull(f, head)
+	head = bytes.TrimLeft(head[:n], "\xef\xbb\xbf \t\r\n")
+
+	if !bytes.HasPrefix(head, []byte("<")) {
+		return false
+	}
+	return bytes.Contains(head, []byte("<svg"))
+}
+
+// rasterizeSVG renders an SVG to a PNG next to it using svgRasterizer and
+// returns the PNG path. A zero width or height is derived from the aspect
+// ratio; when both are zero defaultSVGWidth is used.
+func rasterizeSVG(ctx context.Context, inputPath string, width, height int) (string, []byte, error) {
+	if width == 0 && height == 0 {
+		width = defaultSVGWidth
+	}
+
+	outputPath := inputPath + ".png"
+	var args []string
+	switch svgRasterizer {
+	case "rsvg-convert":
+		args = append(args, "--keep-aspect-ratio", "-f", "png", "-o", outputPath)
+		if width > 0 {
+			args = append(args, "-w", strconv.Itoa(width))
+		}
+		if height > 0 {
+			args = append(args, "-h", strconv.Itoa(height))
+		}
+		args = append(args, inputPath)
+	case "resvg":
+		if width > 0 {
+			args = append(args, "-w", strconv.Itoa(width))
+		}
+		if height > 0 {
+			args = append(args, "-h", strconv.Itoa(height))
+		}
+		args = append(args, inputPath, outputPath)
+	default:
+		return "", nil, fmt.Errorf("no SVG rasterizer available")
+	}
+
+	output, err := runTool(ctx, svgRasterizer, args)
+	if err != nil {
+		return "", output, err
+	}
+	return outputPath, nil, nil
+}
+
+// svgRootPattern matches the opening tag of an SVG's root element
+var svgRootPattern = regexp.MustCompile(`(?s)<svg\b[^>]*>`)
+
+// svgAttrPattern matches one attribute of an SVG's root element
+var svgAttrPattern = regexp.MustCompile(`\b(width|height|viewBox)\s*=\s*["']([^"']*)["']`)
+
+// svgIntrinsicSize reads the size an SVG declares for itself from the
+// width and height of its root element, falling back to the viewBox for
+// whichever is missing or not in pixels. It reports false when the size
+// can't be told.
+func svgIntrinsicSize(path string) (float64, float64, bool) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, false
+	}
+	defer f.Close()
+
+	head := make([]byte, svgSniffLen)
+	n, _ := io.ReadFull(f, head)
+	root := svgRootPattern.Find(head[:n])
+	if root == nil {
+		return 0, 0, false
+	}
+
+	var width, height, boxWidth, boxHeight float64
+	for _, attr := range svgAttrPattern.FindAllSubmatch(root, -1) {
+		value := strings.TrimSpace(string(attr[2]))
+		switch string(attr[1]) {
+		case "width":
+			width = svgPixels(value)
+		case "height":
+			height = svgPixels(value)
+		case "viewBox":
+			fields := strings.Fields(strings.ReplaceAll(value, ",", " "))
+			if len(fields) == 4 {
+				boxWidth, _ = strconv.ParseFloat(fields[2], 64)
+				boxHeight, _ = strconv.ParseFloat(fields[3], 64)
+			}
+		}
+	}
+
+	if boxWidth > 0 && boxHeight > 0 {
+		switch {
+		case width == 0 && height == 0:
+			width, height = boxWidth, boxHeight
+		case width == 0:
+			width = height * boxWidth / boxHeight
+		case height == 0:
+			height = width * boxHeight / boxWidth
+		}
+	}
+	return width, height, width > 0 && height > 0
+}
+
+// svgPixels parses an SVG length given in pixels, returning 0 for anything
+// else (percentages, physical units)
+func svgPixels(value string) float64 {
+	n, err := strconv.ParseFloat(strings.TrimSuffix(value, "px"), 64)
+	if err != nil || n < 0 || math.IsInf(n, 0) {
+		return 0
+	}
+	return n
+}
+
+// svgRenderSize returns the size rasterizeSVG will render an SVG at for the
+// requested width and height, deriving a zero dimension from the SVG's own
+// aspect ratio as the rasterizers do. When the SVG doesn't declare a size
+// the request's dimensions are returned as they are.
+func svgRenderSize(path string, width, height int) (int, int) {
+	if width > 0 && height > 0 {
+		return width, height
+	}
+	if width == 0 && height == 0 {
+		width = defaultSVGWidth
+	}
+	intrinsicWidth, intrinsicHeight, ok := svgIntrinsicSize(path)
+	if !ok {
+		return width, height
+	}
+	if width > 0 {
+		return width, int(math.Min(math.Ceil(float64(width)*intrinsicHeight/intrinsicWidth), math.MaxInt32))
+	}
+	return int(math.Min(math.Ceil(float64(height)*intrinsicWidth/intrinsicHeight), math.MaxInt32)), height
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Permissions for in-flight user images, which must not be readable by
+// other users on shared hosts
+const (
+	privateDirPerm  = 0o700
+	privateFilePerm = 0o600
+)
+
+// tempDirPattern names the per-request working directories
+const tempDirPattern = "webp-convert-*"
+
+// createTempDir makes a per-request working directory only the service
+// user can enter
+func createTempDir() (string, error) {
+	dir, err := os.MkdirTemp("", tempDirPattern)
+	if err != nil {
+		return "", err
+	}
+	// MkdirTemp already uses 0700, but don't rely on it
+	if err := os.Chmod(dir, privateDirPerm); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
+
+// createPrivateFile creates (or truncates) a file readable only by the
+// service user
+func createPrivateFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, privateFilePerm)
+}
+
+// sweeping is set while a stale temp sweep runs, so that a burst of
+// disk-full errors starts only one
+var sweeping atomic.Bool
+
+// respondDiskFull answers 507 when err means the disk is full, and reports
+// whether it did. The condition is logged for alerting and a sweep of
+// stale working directories is started to free space.
+func respondDiskFull(c *gin.Context, err error) bool {
+	if !errors.Is(err, syscall.ENOSPC) {
+		return false
+	}
+	log.Printf("DISK FULL: %v", err)
+	if sweeping.CompareAndSwap(false, true) {
+		go func() {
+			defer sweeping.Store(false)
+			sweepStaleTempDirs(cfg.StaleTempAge)
+		}()
+	}
+	c.JSON(http.StatusInsufficientStorage, gin.H{"error": "Server is out of disk space, try again later"})
+	return true
+}
+
+// sweepStaleTempDirs removes working directories older than maxAge, which
+// are left behind when a process is killed mid-request
+func sweepStaleTempDirs(maxAge time.Duration) {
+	dirs, err := filepath.Glob(filepath.Join(os.TempDir(), tempDirPattern))
+	if err != nil {
+		return
+	}
+	removed := 0
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Failed to remove stale temp directory %s: %v", dir, err)
+			continue
+		}
+		removed++
+	}
+	log.Printf("Removed %d stale temp directories older than %s", removed, maxAge)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tusVersion is the tus resumable upload protocol version implemented
+const tusVersion = "1.0.0"
+
+// tusExtensions are the tus protocol extensions supported, as advertised
+// to OPTIONS requests
+const tusExtensions = "creation,termination,expiration"
+
+// tusUploadContextKey carries a completed resumable upload into
+// convertToWebP in place of a request body
+const tusUploadContextKey = "tusUpload"
+
+// tusInfo is the state of a resumable upload, stored next to its data so
+// uploads survive restarts
+type tusInfo struct {
+	Length   int64     `json:"length"`
+	Filename string    `json:"filename"`
+	Expires  time.Time `json:"expires"`
+}
+
+// tusStore keeps partial uploads on disk until they are converted or expire.
+// Each upload is a data file named by its ID plus a .json info file.
+type tusStore struct {
+	dir string
+	ttl time.Duration
+
+	mu sync.Mutex
+	// busy marks uploads with a PATCH in progress; tus allows only one
+	// writer per upload at a time
+	busy map[string]bool
+}
+
+// uploads is the resumable upload store
+var uploads *tusStore
+
+// newTusStore opens (creating if needed) the upload directory
+func newTusStore(dir string, ttl time.Duration) (*tusStore, error) {
+	if err := os.MkdirAll(dir, privateDirPerm); err != nil {
+		return nil, err
+	}
+	return &tusStore{dir: dir, ttl: ttl, busy: make(map[string]bool)}, nil
+}
+
+func (s *tusStore) dataPath(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+func (s *tusStore) infoPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// isUploadID reports whether id has the form generated by create, so that
+// request paths can never point outside the store
+func isUploadID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// create starts a new upload of the given length
+func (s *tusStore) create(length int64, filename string) (string, tusInfo, error) {
+	var raw [16]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return "", tusInfo{}, err
+	}
+	id := hex.EncodeToString(raw[:])
+
+	info := tusInfo{Length: length, Filename: filename, Expires: time.Now().Add(s.ttl)}
+	data, err := createPrivateFile(s.dataPath(id))
+	if err != nil {
+		return "", tusInfo{}, err
+	}
+	data.Close()
+	if err := s.writeInfo(id, info); err != nil {
+		os.Remove(s.dataPath(id))
+		return "", tusInfo{}, err
+	}
+	return id, info, nil
+}
+
+func (s *tusStore) writeInfo(id string, info tusInfo) error {
+	encoded, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	f, err := createPrivateFile(s.infoPath(id))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(encoded); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// stat returns an upload's info and current offset, reporting false for
+// unknown or expired uploads
+func (s *tusStore) stat(id string) (tusInfo, int64, bool) {
+	if !isUploadID(id) {
+		return tusInfo{}, 0, false
+	}
+	encoded, err := os.ReadFile(s.infoPath(id))
+	if err != nil {
+		return tusInfo{}, 0, false
+	}
+	var info tusInfo
+	if err := json.Unmarshal(encoded, &info); err != nil || time.Now().After(info.Expires) {
+		return tusInfo{}, 0, false
+	}
+	fileInfo, err := os.Stat(s.dataPath(id))
+	if err != nil {
+		return tusInfo{}, 0, false
+	}
+	return info, fileInfo.Size(), true
+}
+
+// lock claims an upload for writing, reporting false if another request
+// holds it
+func (s *tusStore) lock(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.busy[id] {
+		return false
+	}
+	s.busy[id] = true
+	return true
+}
+
+func (s *tusStore) unlock(id string) {
+	s.mu.Lock()
+	delete(s.busy, id)
+	s.mu.Unlock()
+}
+
+// remove deletes an upload's data and info
+func (s *tusStore) remove(id string) {
+	os.Remove(s.dataPath(id))
+	os.Remove(s.infoPath(id))
+}
+
+// sweep removes expired uploads, and data files whose info is missing
+func (s *tusStore) sweep() {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("Failed to sweep uploads: %v", err)
+		return
+	}
+	for _, f := range files {
+		id := strings.TrimSuffix(f.Name(), ".json")
+		if !isUploadID(id) || f.Name() != id {
+			continue
+		}
+		if _, _, ok := s.stat(id); !ok && s.lock(id) {
+			s.remove(id)
+			s.unlock(id)
+		}
+	}
+}
+
+// sweepLoop runs sweep at startup and then periodically for the life of
+// the process
+func (s *tusStore) sweepLoop() {
+	s.sweep()
+	interval := min(s.ttl, time.Hour)
+	for range time.Tick(interval) {
+		s.sweep()
+	}
+}
+
+// parseUploadMetadata decodes the tus Upload-Metadata header, a
+// comma-separated list of "key base64value" pairs
+func parseUploadMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			continue
+		}
+		metadata[key] = string(decoded)
+	}
+	return metadata
+}
+
+// tusHeaders sets the headers every tus response carries
+func tusHeaders(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Cache-Control", "no-store")
+}
+
+// requireTusResumable rejects tus requests that don't declare the protocol
+// version the server implements with 412, as the protocol requires
+func requireTusResumable() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("Tus-Resumable") != tusVersion {
+			tusHeaders(c)
+			c.Header("Tus-Version", tusVersion)
+			c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{
+				"error":     "Unsupported or missing Tus-Resumable version",
+				"supported": tusVersion,
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// isTusPath reports whether path is under /uploads, where OPTIONS requests
+// get the tus discovery headers
+func isTusPath(path string) bool {
+	return path == "/uploads" || strings.HasPrefix(path, "/uploads/")
+}
+
+// tusDiscoveryHeaders sets the headers an OPTIONS request to /uploads is
+// answered with: the versions, extensions and maximum size supported
+func tusDiscoveryHeaders(c *gin.Context) {
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	if cfg.MaxUploadBytes > 0 {
+		c.Header("Tus-Max-Size", strconv.FormatInt(cfg.MaxUploadBytes, 10))
+	}
+}
+
+// createUpload starts a resumable upload (tus creation extension)
+func createUpload(c *gin.Context) {
+	tusHeaders(c)
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Length must be a non-negative integer"})
+		return
+	}
+	if cfg.MaxUploadBytes > 0 && length > cfg.MaxUploadBytes {
+		uploadTooLarge().respond(c)
+		return
+	}
+
+	filename := parseUploadMetadata(c.GetHeader("Upload-Metadata"))["filename"]
+	if filename == "" {
+		filename = "image"
+	}
+
+	id, info, err := uploads.create(length, filename)
+	if respondDiskFull(c, err) {
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload"})
+		return
+	}
+
+	c.Header("Location", "/uploads/"+id)
+	c.Header("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusCreated)
+}
+
+// headUpload reports how much of an upload the server has, so the client
+// can resume from there
+func headUpload(c *gin.Context) {
+	tusHeaders(c)
+	info, offset, ok := uploads.stat(c.Param("id"))
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(info.Length, 10))
+	c.Header("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusOK)
+}
+
+// patchUpload appends a chunk at the offset the client claims, which must
+// match what the server already has
+func patchUpload(c *gin.Context) {
+	tusHeaders(c)
+	id := c.Param("id")
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be application/offset+octet-stream"})
+		return
+	}
+	if !uploads.lock(id) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload is being written by another request"})
+		return
+	}
+	defer uploads.unlock(id)
+
+	info, offset, ok := uploads.stat(id)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return
+	}
+	claimed, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || claimed != offset {
+		c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload-Offset doesn't match the upload", "offset": offset})
+		return
+	}
+	remaining := info.Length - offset
+	if c.Request.ContentLength > remaining {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Chunk extends past Upload-Length", "remaining": remaining})
+		return
+	}
+
+	f, err := os.OpenFile(uploads.dataPath(id), os.O_WRONLY|os.O_APPEND, privateFilePerm)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open upload"})
+		return
+	}
+	// Whatever arrived before a dropped connection is kept, which is the
+	// point of resuming
+	written, copyErr := io.Copy(f, io.LimitReader(c.Request.Body, remaining))
+	closeErr := f.Close()
+	if respondDiskFull(c, copyErr) || respondDiskFull(c, closeErr) {
+		return
+	}
+	if copyErr != nil && written == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read chunk"})
+		return
+	}
+	if closeErr != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to write upload"})
+		return
+	}
+
+	c.Header("Upload-Offset", strconv.FormatInt(offset+written, 10))
+	c.Header("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+	c.Status(http.StatusNoContent)
+}
+
+// deleteUpload abandons an upload (tus termination extension)
+func deleteUpload(c *gin.Context) {
+	tusHeaders(c)
+	id := c.Param("id")
+	if _, _, ok := uploads.stat(id); !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	if !uploads.lock(id) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload is being written by another request"})
+		return
+	}
+	uploads.remove(id)
+	uploads.unlock(id)
+	c.Status(http.StatusNoContent)
+}
+
+// convertUpload runs the /convert pipeline on a completed resumable upload,
+// taking the options from the query string as usual
+func convertUpload(c *gin.Context) {
+	id := c.Param("id")
+	info, offset, ok := uploads.stat(id)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Upload not found"})
+		return
+	}
+	if offset != info.Length {
+		c.JSON(http.StatusConflict, gin.H{"error": "Upload is incomplete", "offset": offset, "length": info.Length})
+		return
+	}
+
+	f, err := os.Open(uploads.dataPath(id))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to open upload"})
+		return
+	}
+	c.Set(tusUploadContextKey, &upload{Reader: f, name: info.Filename, size: info.Length, close: f.Close})
+	convertToWebP(c)
+}
+
+// tusUpload returns the resumable upload handed over by convertUpload, if any
+func tusUpload(c *gin.Context) (*upload, bool) {
+	value, ok := c.Get(tusUploadContextKey)
+	if !ok {
+		return nil, false
+	}
+	u, ok := value.(*upload)
+	return u, ok
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// httpError is a failed request step carrying the response to send
+type httpError struct {
+	status int
+	body   gin.H
+}
+
+func (e *httpError) respond(c *gin.Context) {
+	c.JSON(e.status, e.body)
+}
+
+// upload is the source image of a conversion, whichever way it was sent
+type upload struct {
+	io.Reader
+	// name is the client's filename, used to derive the output name
+	name  string
+	size  int64
+	close func() error
+}
+
+func (u *upload) Close() error {
+	if u.close == nil {
+		return nil
+	}
+	return u.close()
+}
+
+// isJSONRequest reports whether the request body is JSON rather than a
+// multipart upload
+func isJSONRequest(c *gin.Context) bool {
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	return mediaType == "application/json"
+}
+
+// openUpload returns the image sent with the request, either as the
+// multipart "image" field or, for JSON requests, as a data URI in
+// {"dataUri": "data:image/png;base64,..."} or, when ALLOW_LOCAL_PATHS is
+// set, a server-side file in {"path": "/data/img.png"}
+func openUpload(c *gin.Context) (*upload, *httpError) {
+	if u, ok := tusUpload(c); ok {
+		return u, nil
+	}
+	if u, ok := batchUpload(c); ok {
+		return u, nil
+	}
+	if isJSONRequest(c) {
+		return openDataURIUpload(c)
+	}
+	// A streamed upload is read up to its first image, so other duplicate
+	// policies need the whole form
+	if cfg.StreamUploads && cfg.MultipartDuplicatePolicy == duplicateFirst {
+		return openStreamedUpload(c)
+	}
+
+	// Get the uploaded file
+	file, header, err := c.Request.FormFile("image")
+	if isBodyTooLarge(err) {
+		return nil, uploadTooLarge()
+	}
+	if err != nil {
+		return nil, &httpError{http.StatusBadRequest, gin.H{"error": "No image file provided"}}
+	}
+	// A part with a filename but no content is a common client bug
+	if header.Size == 0 {
+		file.Close()
+		return nil, emptyUpload()
+	}
+	if count := len(c.Request.MultipartForm.File["image"]); count > 1 && cfg.MultipartDuplicatePolicy == duplicateStrict {
+		file.Close()
+		return nil, duplicateImages(count)
+	}
+	return &upload{Reader: file, name: header.Filename, size: header.Size, close: file.Close}, nil
+}
+
+// openDataURIUpload decodes a base64 data URI from a JSON request body, or
+// opens the local file it names
+func openDataURIUpload(c *gin.Context) (*upload, *httpError) {
+	var body struct {
+		DataURI string `json:"dataUri"`
+		Path    string `json:"path"`
+	}
+	if err := json.NewDecoder(c.Request.Body).Decode(&body); err != nil {
+		if isBodyTooLarge(err) {
+			return nil, uploadTooLarge()
+		}
+		return nil, &httpError{http.StatusBadRequest, gin.H{"error": "Invalid JSON body"}}
+	}
+	if body.Path != "" {
+		return openLocalUpload(body.Path)
+	}
+	if body.DataURI == "" {
+		return nil, &httpError{http.StatusBadRequest, gin.H{"error": "No image file provided"}}
+	}
+
+	mediaType, data, err := parseDataURI(body.DataURI)
+	if err != nil {
+		return nil, &httpError{http.StatusBadRequest, gin.H{"error": "Invalid data URI", "details": err.Error()}}
+	}
+	if len(data) == 0 {
+		return nil, emptyUpload()
+	}
+	if !strings.HasPrefix(mediaType, "image/") {
+		return nil, &httpError{http.StatusUnsupportedMediaType, gin.H{"error": "Data URI must contain an image"}}
+	}
+	if cfg.MaxUploadBytes > 0 && int64(len(data)) > cfg.MaxUploadBytes {
+		return nil, uploadTooLarge()
+	}
+
+	// Name the upload after its media type, e.g. image.png
+	name := "image"
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		name += exts[0]
+	}
+	return &upload{Reader: bytes.NewReader(data), name: name, size: int64(len(data))}, nil
+}
+
+// parseDataURI splits a base64 data URI into its media type and payload
+func parseDataURI(uri string) (string, []byte, error) {
+	rest, ok := strings.CutPrefix(uri, "data:")
+	if !ok {
+		return "", nil, errors.New(`must start with "data:"`)
+	}
+	meta, payload, ok := strings.Cut(rest, ",")
+	if !ok {
+		return "", nil, errors.New("missing ',' before the data")
+	}
+	meta, ok = strings.CutSuffix(meta, ";base64")
+	if !ok {
+		return "", nil, errors.New("only base64 data URIs are supported")
+	}
+
+	mediaType, _, err := mime.ParseMediaType(meta)
+	if err != nil {
+		return "", nil, errors.New("invalid media type")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(payload))
+	if err != nil {
+		return "", nil, errors.New("invalid base64 data")
+	}
+	return mediaType, data, nil
+}
+
+// uploadTooLarge is the 413 response for uploads over MAX_UPLOAD_BYTES
+func uploadTooLarge() *httpError {
+	return &httpError{http.StatusRequestEntityTooLarge, gin.H{
+		"error":    "Upload exceeds the maximum allowed size",
+		"maxBytes": cfg.MaxUploadBytes,
+	}}
+}
+
+// emptyUpload is the 400 response for a zero-byte image, which would
+// otherwise fail inside cwebp with an obscure message
+func emptyUpload() *httpError {
+	return &httpError{http.StatusBadRequest, gin.H{"error": "empty image"}}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+)
+
+// videoSniffLen covers the container signatures checked by videoFormat
+const videoSniffLen = 16
+
+// stillImageBrands are ISO base media brands used by image formats, which
+// share the MP4 container but aren't video
+var stillImageBrands = map[string]bool{
+	"avif": true,
+	"avis": true,
+	"heic": true,
+	"heix": true,
+	"mif1": true,
+	"msf1": true,
+}
+
+// errNoVideoFrame means ffmpeg found no frame at the requested timestamp
+var errNoVideoFrame = errors.New("no frame at the requested timestamp")
+
+// videoFormat identifies common video containers from their signature:
+// "mp4" (including QuickTime), "webm" (including Matroska), "avi", or ""
+func videoFormat(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	head := make([]byte, videoSniffLen)
+	if _, err := io.ReadFull(f, head); err != nil {
+		return ""
+	}
+	switch {
+	case string(head[4:8]) == "ftyp" && !stillImageBrands[string(head[8:12])]:
+		return "mp4"
+	case bytes.HasPrefix(head, []byte{0x1a, 0x45, 0xdf, 0xa3}):
+		return "webm"
+	case string(head[0:4]) == "RIFF" && string(head[8:12]) == "AVI ":
+		return "avi"
+	}
+	return ""
+}
+
+// isVideoFormat reports whether a detectFormat result is a video container
+func isVideoFormat(format string) bool {
+	return format == "mp4" || format == "webm" || format == "avi"
+}
+
+// extractVideoFrame saves the frame at timestamp seconds to a PNG next to
+// the video with ffmpeg and returns the PNG path, or ffmpeg's output for
+// the error response
+func extractVideoFrame(ctx context.Context, inputPath string, timestamp float64) (string, []byte, error) {
+	outputPath := inputPath + ".frame.png"
+	args := []string{
+		"-nostdin", "-v", "error",
+		"-ss", strconv.FormatFloat(timestamp, 'f', -1, 64),
+		"-i", inputPath,
+		"-frames:v", "1", "-y", outputPath,
+	}
+	if output, err := runTool(ctx, "ffmpeg", args); err != nil {
+		return "", output, err
+	}
+	// Seeking past the end succeeds without writing anything
+	if _, err := os.Stat(outputPath); err != nil {
+		return "", nil, errNoVideoFrame
+	}
+	return outputPath, nil, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webpHeaderPeek is how much of a WebP file is read to find its features;
+// the image chunk headers sit near the start
+const webpHeaderPeek = 1 << 20
+
+// webpFeatures describes an encoded WebP as read from its own chunks
+type webpFeatures struct {
+	Width    int  `json:"width"`
+	Height   int  `json:"height"`
+	Lossless bool `json:"lossless"`
+	Alpha    bool `json:"alpha"`
+	Animated bool `json:"animated"`
+}
+
+var errNotWebP = errors.New("not a WebP file")
+
+// parseWebPFeatures reads dimensions and features from the RIFF chunks of
+// a WebP file (VP8X, VP8, VP8L, ALPH, ANMF). data may be a prefix of the
+// file as long as it covers the first image chunk header.
+func parseWebPFeatures(data []byte) (webpFeatures, error) {
+	var f webpFeatures
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return f, errNotWebP
+	}
+
+	extended := false
+	for pos := 12; pos+8 <= len(data); {
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		payload := data[pos+8:]
+		if len(payload) > size {
+			payload = payload[:size]
+		}
+
+		switch fourCC {
+		case "VP8X":
+			if len(payload) < 10 {
+				return f, errNotWebP
+			}
+			extended = true
+			flags := payload[0]
+			f.Alpha = flags&0x10 != 0
+			f.Animated = flags&0x02 != 0
+			f.Width = int(uint32(payload[4])|uint32(payload[5])<<8|uint32(payload[6])<<16) + 1
+			f.Height = int(uint32(payload[7])|uint32(payload[8])<<8|uint32(payload[9])<<16) + 1
+
+		case "ANMF":
+			// The first frame's bitstream tells lossy from lossless;
+			// frame data starts after its 16 byte header
+			if len(payload) >= 24 {
+				f.Lossless = string(payload[16:20]) == "VP8L"
+			}
+			return f, nil
+
+		case "VP8 ":
+			// Keyframe: 3 byte frame tag, start code 9d 01 2a, then 14 bit
+			// width and height
+			if len(payload) < 10 || payload[3] != 0x9d || payload[4] != 0x01 || payload[5] != 0x2a {
+				return f, errNotWebP
+			}
+			if !extended {
+				f.Width = int(binary.LittleEndian.Uint16(payload[6:]) & 0x3fff)
+				f.Height = int(binary.LittleEndian.Uint16(payload[8:]) & 0x3fff)
+			}
+			return f, nil
+
+		case "VP8L":
+			// Signature 0x2f, then 14 bit width-1, 14 bit height-1, alpha bit
+			if len(payload) < 5 || payload[0] != 0x2f {
+				return f, errNotWebP
+			}
+			f.Lossless = true
+			bits := binary.LittleEndian.Uint32(payload[1:])
+			// The bitstream's own alpha hint counts even in extended files,
+			// whose VP8X alpha flag isn't always set for VP8L
+			f.Alpha = f.Alpha || bits>>28&1 != 0
+			if !extended {
+				f.Width = int(bits&0x3fff) + 1
+				f.Height = int(bits>>14&0x3fff) + 1
+			}
+			return f, nil
+		}
+
+		// Chunks are padded to an even size
+		pos += 8 + size + size&1
+	}
+
+	return f, errNotWebP
+}
+
+// compressionOf returns "lossless" or "lossy" for encoded WebP data
+func compressionOf(data []byte) string {
+	if features, err := parseWebPFeatures(data); err == nil && features.Lossless {
+		return "lossless"
+	}
+	return "lossy"
+}
+
+// setWebPFeatureHeaders reports the output's own features to the client.
+// X-Image-Width and X-Image-Height are the dimensions as displayed: rotated
+// pixels already are, while a keep_tag output whose EXIF orientation turns
+// it sideways has its stored width and height swapped.
+func setWebPFeatureHeaders(c *gin.Context, f webpFeatures) {
+	compression := "lossy"
+	if f.Lossless {
+		compression = "lossless"
+	}
+	width, height := f.Width, f.Height
+	if swapsAxes(c.GetInt(keptOrientationKey)) {
+		width, height = height, width
+	}
+	c.Header("X-Image-Width", strconv.Itoa(width))
+	c.Header("X-Image-Height", strconv.Itoa(height))
+	c.Header("X-WebP-Width", strconv.Itoa(f.Width))
+	c.Header("X-WebP-Height", strconv.Itoa(f.Height))
+	c.Header("X-WebP-Compression", compression)
+	c.Header("X-WebP-Alpha", strconv.FormatBool(f.Alpha))
+	c.Header("X-WebP-Animated", strconv.FormatBool(f.Animated))
+}
+
+// isAnimatedWebP reports whether a file is a WebP with an animation
+func isAnimatedWebP(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, webpHeaderPeek)
+	n, _ := io.ReadFull(f, head)
+	features, err := parseWebPFeatures(head[:n])
+	return err == nil && features.Animated
+}